@@ -0,0 +1,122 @@
+package coin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+func init() {
+	RegisterPoW(0, AESHAM2{})
+	RegisterPoW(1, AESHAM2{})
+	RegisterPoW(2, AESHAM2{})
+}
+
+// AESHAM2 is the 2018 puzzle: find nonces i != j such that
+// A(i) + B(j) and A(j) + B(i) agree in at least Difficulty bits, where A and
+// B are AES keyed by the header and Nonces[0].
+type AESHAM2 struct{}
+
+func (AESHAM2) Name() string {
+	return "AESHAM2"
+}
+
+func (AESHAM2) Verify(h *Header) error {
+	if h.Nonces[1] == h.Nonces[2] {
+		return ErrInvalidPoW
+	}
+
+	A, B := AESHAM2{}.Ciphers(h)
+	Ai := A.Encrypt(h.Nonces[1])
+	Aj := A.Encrypt(h.Nonces[2])
+	Bi := B.Encrypt(h.Nonces[1])
+	Bj := B.Encrypt(h.Nonces[2])
+	d := HammingCloseness(Ai, Aj, Bi, Bj)
+
+	if d < h.Difficulty {
+		return ErrInvalidPoW
+	}
+
+	return nil
+}
+
+// Mine is the straightforward quadratic search.  It is only practical for low
+// difficulties; package miner implements the real birthday attack.
+func (AESHAM2) Mine(h *Header) error {
+	A, B := AESHAM2{}.Ciphers(h)
+	aesA := make([]Uint128, 0)
+	aesB := make([]Uint128, 0)
+	for i := uint64(0); ; i++ {
+		aesA = append(aesA, A.Encrypt(i))
+		aesB = append(aesB, B.Encrypt(i))
+		for j := uint64(0); j < i; j++ {
+			if HammingCloseness(aesA[i], aesA[j], aesB[i], aesB[j]) >= h.Difficulty {
+				h.Nonces[1] = i
+				h.Nonces[2] = j
+				return nil
+			}
+		}
+	}
+}
+
+// Ciphers returns the AES ciphers A and B keyed by h and h.Nonces[0].
+func (AESHAM2) Ciphers(h *Header) (*Cipher, *Cipher) {
+	var b [32 + 32 + 8 + 8 + 8 + 1]byte
+	copy(b[:], h.ParentID[:])
+	copy(b[32:], h.MerkleRoot[:])
+	binary.BigEndian.PutUint64(b[32+32:], h.Difficulty)
+	binary.BigEndian.PutUint64(b[32+32+8:], uint64(h.Timestamp))
+	binary.BigEndian.PutUint64(b[32+32+8+8:], h.Nonces[0])
+	b[32+32+8+8+8] = h.Version
+	seed := sha256.Sum256(b[:])
+	seed2 := sha256.Sum256(seed[:])
+	A, _ := aes.NewCipher(seed[:])
+	B, _ := aes.NewCipher(seed2[:])
+	return &Cipher{block: A}, &Cipher{block: B}
+}
+
+// Cipher is one of the two AESHAM2 ciphers.  It carries its own scratch
+// block so that Encrypt does not allocate, and is not safe for concurrent
+// use.
+type Cipher struct {
+	block cipher.Block
+	buf   [16]byte
+}
+
+// Encrypt encrypts the 16 byte big-endian encoding of m.
+func (c *Cipher) Encrypt(m uint64) Uint128 {
+	c.buf = [16]byte{}
+	binary.BigEndian.PutUint64(c.buf[8:], m)
+	c.block.Encrypt(c.buf[:], c.buf[:])
+	return Uint128{binary.BigEndian.Uint64(c.buf[:8]), binary.BigEndian.Uint64(c.buf[8:])}
+}
+
+// Uint128 is a big-endian 128-bit integer; all arithmetic is mod 2^128.
+type Uint128 struct {
+	Hi, Lo uint64
+}
+
+func (x Uint128) Add(y Uint128) Uint128 {
+	lo, carry := bits.Add64(x.Lo, y.Lo, 0)
+	hi, _ := bits.Add64(x.Hi, y.Hi, carry)
+	return Uint128{hi, lo}
+}
+
+func (x Uint128) Sub(y Uint128) Uint128 {
+	lo, borrow := bits.Sub64(x.Lo, y.Lo, 0)
+	hi, _ := bits.Sub64(x.Hi, y.Hi, borrow)
+	return Uint128{hi, lo}
+}
+
+// Closeness is the number of bit positions in which x and y agree.
+func (x Uint128) Closeness(y Uint128) uint64 {
+	return uint64(128 - bits.OnesCount64(x.Hi^y.Hi) - bits.OnesCount64(x.Lo^y.Lo))
+}
+
+// HammingCloseness counts the bits in which Ai + Bj and Aj + Bi (mod 2^128)
+// agree.
+func HammingCloseness(Ai, Aj, Bi, Bj Uint128) uint64 {
+	return Ai.Add(Bj).Closeness(Aj.Add(Bi))
+}
@@ -0,0 +1,170 @@
+package coin
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// computeAES and computeHammingCloseness are the original big.Int
+// implementations, kept as a reference for Cipher.Encrypt and HammingCloseness.
+func computeAES(block cipher.Block, m uint64) *big.Int {
+	blockM := make([]byte, 16)
+	binary.BigEndian.PutUint64(blockM, 0)
+	binary.BigEndian.PutUint64(blockM[8:], m)
+	blockC := make([]byte, 16)
+	block.Encrypt(blockC, blockM)
+	c := new(big.Int).SetBytes(blockC[:])
+	return c
+}
+
+func computeHammingCloseness(Ai, Aj, Bi, Bj *big.Int) uint64 {
+	int128 := new(big.Int).SetUint64(128)
+	mod := new(big.Int).SetUint64(2)
+	mod.Exp(mod, int128, nil)
+
+	AiBj := new(big.Int).SetUint64(0)
+	AiBj.Add(Ai, Bj)
+	AiBj.Mod(AiBj, mod)
+	AjBi := new(big.Int).SetUint64(0)
+	AjBi.Add(Aj, Bi)
+	AjBi.Mod(AjBi, mod)
+
+	xor := new(big.Int).SetUint64(0)
+	xor.Xor(AiBj, AjBi)
+	s := fmt.Sprintf("%0128b", xor)
+	return uint64(strings.Count(s, "0"))
+}
+
+func toBig(x Uint128) *big.Int {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], x.Hi)
+	binary.BigEndian.PutUint64(buf[8:], x.Lo)
+	return new(big.Int).SetBytes(buf[:])
+}
+
+func randomHeader(r *rand.Rand) Header {
+	var h Header
+	r.Read(h.ParentID[:])
+	r.Read(h.MerkleRoot[:])
+	h.Difficulty = uint64(r.Intn(129))
+	h.Timestamp = r.Int63()
+	h.Nonces[0] = r.Uint64()
+	h.Version = uint8(r.Intn(3))
+	return h
+}
+
+func TestEncryptMatchesBigInt(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 100; n++ {
+		h := randomHeader(r)
+		A, B := AESHAM2{}.Ciphers(&h)
+		for _, c := range []*Cipher{A, B} {
+			m := r.Uint64()
+			if got, want := toBig(c.Encrypt(m)), computeAES(c.block, m); got.Cmp(want) != 0 {
+				t.Fatalf("Encrypt(%d) = %x, want %x", m, got, want)
+			}
+		}
+	}
+}
+
+func TestHammingClosenessMatchesBigInt(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func() Uint128 {
+		return Uint128{r.Uint64(), r.Uint64()}
+	}
+	edges := []Uint128{{0, 0}, {0, ^uint64(0)}, {^uint64(0), 0}, {^uint64(0), ^uint64(0)}, {0, 1}}
+
+	check := func(Ai, Aj, Bi, Bj Uint128) {
+		got := HammingCloseness(Ai, Aj, Bi, Bj)
+		want := computeHammingCloseness(toBig(Ai), toBig(Aj), toBig(Bi), toBig(Bj))
+		if got != want {
+			t.Fatalf("HammingCloseness(%v, %v, %v, %v) = %d, want %d",
+				Ai, Aj, Bi, Bj, got, want)
+		}
+	}
+
+	for n := 0; n < 10000; n++ {
+		check(random(), random(), random(), random())
+	}
+	for _, Ai := range edges {
+		for _, Bj := range edges {
+			check(Ai, random(), random(), Bj)
+			check(Ai, Bj, Bj, Ai)
+		}
+	}
+}
+
+func TestVerifyMatchesBigInt(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 1000; n++ {
+		h := randomHeader(r)
+		h.Nonces[1], h.Nonces[2] = r.Uint64(), r.Uint64()
+		h.Difficulty = uint64(48 + r.Intn(32))
+
+		A, B := AESHAM2{}.Ciphers(&h)
+		d := computeHammingCloseness(
+			computeAES(A.block, h.Nonces[1]), computeAES(A.block, h.Nonces[2]),
+			computeAES(B.block, h.Nonces[1]), computeAES(B.block, h.Nonces[2]))
+		want := d >= h.Difficulty
+
+		if got := (AESHAM2{}).Verify(&h) == nil; got != want {
+			t.Fatalf("Verify(%+v) = %v, want %v (closeness %d)", h, got, want, d)
+		}
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	h := Header{}
+	A, _ := AESHAM2{}.Ciphers(&h)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		A.Encrypt(uint64(i))
+	}
+}
+
+func BenchmarkComputeAESBigInt(b *testing.B) {
+	h := Header{}
+	A, _ := AESHAM2{}.Ciphers(&h)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		computeAES(A.block, uint64(i))
+	}
+}
+
+func BenchmarkHammingCloseness(b *testing.B) {
+	h := Header{}
+	A, B := AESHAM2{}.Ciphers(&h)
+	Ai, Aj, Bi, Bj := A.Encrypt(1), A.Encrypt(2), B.Encrypt(1), B.Encrypt(2)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		HammingCloseness(Ai, Aj, Bi, Bj)
+	}
+}
+
+func BenchmarkHammingClosenessBigInt(b *testing.B) {
+	h := Header{}
+	A, B := AESHAM2{}.Ciphers(&h)
+	Ai, Aj, Bi, Bj := computeAES(A.block, 1), computeAES(A.block, 2), computeAES(B.block, 1), computeAES(B.block, 2)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		computeHammingCloseness(Ai, Aj, Bi, Bj)
+	}
+}
+
+func TestNoAllocs(t *testing.T) {
+	h := Header{}
+	A, B := AESHAM2{}.Ciphers(&h)
+	allocs := testing.AllocsPerRun(100, func() {
+		Ai, Aj := A.Encrypt(1), A.Encrypt(2)
+		Bi, Bj := B.Encrypt(1), B.Encrypt(2)
+		HammingCloseness(Ai, Aj, Bi, Bj)
+	})
+	if allocs != 0 {
+		t.Errorf("Encrypt and HammingCloseness allocate %v times, want 0", allocs)
+	}
+}
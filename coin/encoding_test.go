@@ -0,0 +1,95 @@
+package coin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func TestHeaderBinary(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 100; n++ {
+		h := randomHeader(r)
+		h.Nonces[1], h.Nonces[2] = r.Uint64(), r.Uint64()
+		if n%2 == 1 {
+			h.Timestamp = -h.Timestamp
+		}
+
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != HeaderSize {
+			t.Fatalf("encoded header is %d bytes, want %d", len(b), HeaderSize)
+		}
+
+		var got Header
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if got != h {
+			t.Fatalf("round trip: got %+v, want %+v", got, h)
+		}
+	}
+}
+
+func TestHeaderBinaryIsSumPreimage(t *testing.T) {
+	h := Header{Difficulty: 86, Timestamp: 1519862400000000000, Nonces: [3]uint64{1, 2, 3}, Version: 1}
+	copy(h.ParentID[:], bytes.Repeat([]byte{0xaa}, 32))
+	copy(h.MerkleRoot[:], bytes.Repeat([]byte{0xbb}, 32))
+
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Sum() != sha256.Sum256(b) {
+		t.Error("Sum is not the SHA256 of the binary encoding")
+	}
+
+	want := append(append([]byte(nil), h.ParentID[:]...), h.MerkleRoot[:]...)
+	for _, n := range []uint64{h.Difficulty, uint64(h.Timestamp), 1, 2, 3} {
+		want = binary.BigEndian.AppendUint64(want, n)
+	}
+	want = append(want, h.Version)
+	if !bytes.Equal(b, want) {
+		t.Errorf("encoding %x, want %x", b, want)
+	}
+}
+
+func TestHeaderBinaryLength(t *testing.T) {
+	var h Header
+	for _, n := range []int{0, HeaderSize - 1, HeaderSize + 1} {
+		if err := h.UnmarshalBinary(make([]byte, n)); err != ErrHeaderEncoding {
+			t.Errorf("%d bytes: got %v, want %v", n, err, ErrHeaderEncoding)
+		}
+	}
+}
+
+func TestBlockBinary(t *testing.T) {
+	for _, b := range []Block{"", "alice,bob", Block(bytes.Repeat([]byte{0xff}, MAX_BLOCK_SIZE))} {
+		buf, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != blockLengthSize+len(b) || binary.BigEndian.Uint32(buf) != uint32(len(b)) {
+			t.Errorf("%q: bad length prefix in %x", b, buf[:blockLengthSize])
+		}
+
+		var got Block
+		if err := got.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		}
+		if got != b {
+			t.Errorf("round trip: got %q, want %q", got, b)
+		}
+
+		// Truncated or padded encodings
+		for _, bad := range [][]byte{buf[:len(buf)-1], append(buf, 0), buf[:blockLengthSize-1]} {
+			if err := got.UnmarshalBinary(bad); err != ErrBlockEncoding {
+				t.Errorf("%q, %d bytes: got %v, want %v", b, len(bad), err, ErrBlockEncoding)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package coin
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+)
+
+// EntrySeparator splits a version 1 block into its Merkle tree leaves.
+const EntrySeparator = ","
+
+// Leaves and interior nodes are hashed under different prefixes so that an
+// interior node can never be passed off as an entry.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+var (
+	ErrInvalidMerkleRoot  = errors.New("merkle root does not commit block")
+	ErrMerkleIndex        = errors.New("merkle entry index out of range")
+	ErrInvalidMerkleProof = errors.New("merkle proof does not match root")
+)
+
+// NewBlock joins entries into a version 1 block.
+func NewBlock(entries []string) Block {
+	return Block(strings.Join(entries, EntrySeparator))
+}
+
+// Entries splits a version 1 block into its leaves.
+func (b Block) Entries() []string {
+	return strings.Split(string(b), EntrySeparator)
+}
+
+// MerkleEntries returns the leaves of b's Merkle tree under header version:
+// the comma separated entries of a version 1 block, or the payload entries
+// and team entry of a version 2 block.
+func MerkleEntries(version uint8, b Block) ([]string, error) {
+	switch version {
+	case 1:
+		return b.Entries(), nil
+	case 2:
+		p, err := b.Payload()
+		if err != nil {
+			return nil, err
+		}
+		return p.MerkleEntries(), nil
+	}
+
+	return nil, ErrUnkownVersion
+}
+
+// MerkleRoot computes the root of the binary Merkle tree over entries.  A node
+// without a sibling is promoted to the next level unchanged.
+func MerkleRoot(entries []string) Hash {
+	if len(entries) == 0 {
+		return sha256.Sum256(nil)
+	}
+
+	level := make([]Hash, len(entries))
+	for i, e := range entries {
+		level[i] = merkleLeaf(e)
+	}
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+
+	return level[0]
+}
+
+// MerkleSibling is one step of an inclusion proof: the hash to combine with
+// and whether it sits to the left of the running hash.
+type MerkleSibling struct {
+	Hash Hash `json:"hash"`
+	Left bool `json:"left"`
+}
+
+// MerkleProof is the path of siblings from an entry up to the Merkle root.
+type MerkleProof struct {
+	Siblings []MerkleSibling `json:"siblings"`
+}
+
+// NewMerkleProof builds the inclusion proof for entries[index].
+func NewMerkleProof(entries []string, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(entries) {
+		return nil, ErrMerkleIndex
+	}
+
+	level := make([]Hash, len(entries))
+	for i, e := range entries {
+		level[i] = merkleLeaf(e)
+	}
+
+	proof := &MerkleProof{}
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, MerkleSibling{
+				Hash: level[sibling],
+				Left: sibling < index,
+			})
+		}
+		level = merkleLevel(level)
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// Root recomputes the Merkle root implied by entry and the proof.
+func (p *MerkleProof) Root(entry string) Hash {
+	h := merkleLeaf(entry)
+	for _, s := range p.Siblings {
+		if s.Left {
+			h = merkleNode(s.Hash, h)
+		} else {
+			h = merkleNode(h, s.Hash)
+		}
+	}
+	return h
+}
+
+// Verify reports whether the proof shows that entry is committed by root.
+func (p *MerkleProof) Verify(root Hash, entry string) bool {
+	return p.Root(entry) == root
+}
+
+// VerifyMerkleProof checks that proof shows entry is committed by the Merkle
+// root of h.  Only version 1 and 2 headers commit a Merkle tree.
+func VerifyMerkleProof(h *Header, entry string, proof *MerkleProof) error {
+	if h.Version != 1 && h.Version != 2 {
+		return ErrUnkownVersion
+	}
+	if !proof.Verify(h.MerkleRoot, entry) {
+		return ErrInvalidMerkleProof
+	}
+
+	return nil
+}
+
+func merkleLevel(level []Hash) []Hash {
+	next := make([]Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+		} else {
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+	}
+	return next
+}
+
+func merkleLeaf(entry string) Hash {
+	b := make([]byte, 1+len(entry))
+	b[0] = merkleLeafPrefix
+	copy(b[1:], entry)
+	return sha256.Sum256(b)
+}
+
+func merkleNode(left, right Hash) Hash {
+	var b [1 + 2*sha256.Size]byte
+	b[0] = merkleNodePrefix
+	copy(b[1:], left[:])
+	copy(b[1+sha256.Size:], right[:])
+	return sha256.Sum256(b[:])
+}
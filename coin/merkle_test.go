@@ -0,0 +1,125 @@
+package coin
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func testEntries(n int) []string {
+	entries := make([]string, n)
+	for i := range entries {
+		entries[i] = fmt.Sprintf("entry %d", i)
+	}
+	return entries
+}
+
+func TestMerkleRoot(t *testing.T) {
+	l := make([]Hash, 5)
+	for i, e := range testEntries(5) {
+		l[i] = merkleLeaf(e)
+	}
+
+	tests := []struct {
+		n    int
+		want Hash
+	}{
+		{0, sha256.Sum256(nil)},
+		{1, l[0]},
+		{2, merkleNode(l[0], l[1])},
+		// An odd node is promoted unchanged
+		{3, merkleNode(merkleNode(l[0], l[1]), l[2])},
+		{4, merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3]))},
+		{5, merkleNode(merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3])), l[4])},
+	}
+	for _, test := range tests {
+		if got := MerkleRoot(testEntries(test.n)); got != test.want {
+			t.Errorf("MerkleRoot of %d entries = %s, want %s", test.n, got, test.want)
+		}
+	}
+}
+
+func TestMerkleLeafPrefix(t *testing.T) {
+	// An interior node passed off as a two entry block must not match
+	l0, l1 := merkleLeaf("a"), merkleLeaf("b")
+	if merkleLeaf(string(l0[:])+string(l1[:])) == merkleNode(l0, l1) {
+		t.Error("leaf and interior node hashes collide")
+	}
+}
+
+func TestValidMerkleTree(t *testing.T) {
+	b := NewBlock([]string{"alice", "bob", "carol"})
+	for _, version := range []uint8{0, 1} {
+		h := Header{Version: version}
+		if err := h.SetMerkleRoot(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.validMerkleTree(b); err != nil {
+			t.Errorf("version %d: %v", version, err)
+		}
+		if err := h.validMerkleTree(b + ",dave"); err != ErrInvalidMerkleRoot {
+			t.Errorf("version %d, extra entry: got %v, want %v", version, err, ErrInvalidMerkleRoot)
+		}
+	}
+
+	h := Header{Version: 1}
+	h.SetMerkleRoot(b)
+	if h.MerkleRoot != MerkleRoot([]string{"alice", "bob", "carol"}) {
+		t.Error("version 1 root is not the Merkle root of the entries")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		entries := testEntries(n)
+		root := MerkleRoot(entries)
+		h := &Header{MerkleRoot: root, Version: 1}
+
+		for i, entry := range entries {
+			proof, err := NewMerkleProof(entries, i)
+			if err != nil {
+				t.Fatalf("%d entries, index %d: %v", n, i, err)
+			}
+			if !proof.Verify(root, entry) {
+				t.Errorf("%d entries, index %d: proof does not verify", n, i)
+			}
+			if err := VerifyMerkleProof(h, entry, proof); err != nil {
+				t.Errorf("%d entries, index %d: %v", n, i, err)
+			}
+
+			if proof.Verify(root, "not an entry") {
+				t.Errorf("%d entries, index %d: proof verifies a wrong entry", n, i)
+			}
+			if n > 1 && proof.Verify(root, entries[(i+1)%n]) {
+				t.Errorf("%d entries, index %d: proof verifies another entry", n, i)
+			}
+			if n > 1 && proof.Verify(MerkleRoot(entries[:n-1]), entry) {
+				t.Errorf("%d entries, index %d: proof verifies a wrong root", n, i)
+			}
+			if err := VerifyMerkleProof(h, "not an entry", proof); err != ErrInvalidMerkleProof {
+				t.Errorf("%d entries, index %d: got %v, want %v", n, i, err, ErrInvalidMerkleProof)
+			}
+		}
+
+		for _, i := range []int{-1, n} {
+			if _, err := NewMerkleProof(entries, i); err != ErrMerkleIndex {
+				t.Errorf("%d entries, index %d: got %v, want %v", n, i, err, ErrMerkleIndex)
+			}
+		}
+	}
+}
+
+func TestVerifyMerkleProofVersion(t *testing.T) {
+	entries := testEntries(3)
+	proof, err := NewMerkleProof(entries, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for version, want := range map[uint8]error{0: ErrUnkownVersion, 1: nil, 2: nil, 3: ErrUnkownVersion} {
+		h := &Header{MerkleRoot: MerkleRoot(entries), Version: version}
+		if err := VerifyMerkleProof(h, entries[1], proof); err != want {
+			t.Errorf("version %d: got %v, want %v", version, err, want)
+		}
+	}
+}
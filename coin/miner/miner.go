@@ -0,0 +1,283 @@
+// Package miner implements a parallel birthday attack on the AESHAM2 puzzle.
+//
+// For nonces i and j, A(i) + B(j) - (A(j) + B(i)) = D(i) - D(j) where
+// D(n) = A(n) - B(n).  If D(i) and D(j) share their top k bits the two sums
+// differ by less than 2^(128-k), so they almost always agree on those k bits
+// and on about half of the rest.  The miner therefore buckets nonces by the
+// top bits of D and only checks pairs that land in the same bucket.
+package miner
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../../coin"
+)
+
+var ErrUnsupportedPoW = errors.New("miner only supports AESHAM2 headers")
+
+const (
+	defaultTableBits      = 22
+	defaultNoncesPerSeed  = 1 << 30
+	defaultReportInterval = 5 * time.Second
+)
+
+// Stats is passed to Options.Progress while mining.
+type Stats struct {
+	Nonces   uint64        // nonces evaluated so far, each costing two AES calls
+	Elapsed  time.Duration // time since mining started
+	Hashrate float64       // nonces per second over the last interval
+}
+
+type Options struct {
+	// Workers is the number of goroutines, each mining its own Nonces[0].
+	// Defaults to runtime.NumCPU().
+	Workers int
+
+	// BucketBits is the number of leading bits of D two nonces must share to
+	// be compared.  Defaults to the value minimising the expected number of
+	// nonces for the difficulty, see bucketBits.
+	BucketBits uint
+
+	// TableBits sizes each worker's bucket table at 2^TableBits slots of 8
+	// bytes.  Defaults to 22 (32MB per worker).
+	TableBits uint
+
+	// NoncesPerSeed is how many nonces a worker tries before moving on to
+	// the next Nonces[0].  Capped at 2^32-1.
+	NoncesPerSeed uint64
+
+	// Progress, if set, is called every ReportInterval from its own
+	// goroutine.
+	Progress       func(Stats)
+	ReportInterval time.Duration
+}
+
+func (o *Options) withDefaults(difficulty uint64) Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.TableBits == 0 {
+		opts.TableBits = defaultTableBits
+	}
+	if opts.BucketBits == 0 {
+		opts.BucketBits = bucketBits(difficulty, opts.TableBits)
+	}
+	if opts.BucketBits > 64 {
+		opts.BucketBits = 64
+	}
+	if opts.TableBits > opts.BucketBits {
+		opts.TableBits = opts.BucketBits
+	}
+	// The tag only has room for 32 more bits
+	if opts.BucketBits > opts.TableBits+32 {
+		opts.BucketBits = opts.TableBits + 32
+	}
+	if opts.NoncesPerSeed == 0 || opts.NoncesPerSeed > 1<<32-1 {
+		opts.NoncesPerSeed = defaultNoncesPerSeed
+	}
+	if opts.ReportInterval <= 0 {
+		opts.ReportInterval = defaultReportInterval
+	}
+	return opts
+}
+
+// Mine searches for nonces solving h at h.Difficulty and returns the solved
+// header.  h.MerkleRoot must already be set.  Worker w starts at
+// Nonces[0] = h.Nonces[0] + w and advances by the number of workers.
+func Mine(ctx context.Context, h coin.Header, o *Options) (coin.Header, error) {
+	pow, err := coin.LookupPoW(h.Version)
+	if err != nil {
+		return h, err
+	}
+	if _, ok := pow.(coin.AESHAM2); !ok {
+		return h, ErrUnsupportedPoW
+	}
+
+	opts := o.withDefaults(h.Difficulty)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		nonces uint64
+		once   sync.Once
+		found  coin.Header
+		wg     sync.WaitGroup
+	)
+
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			t := newTable(opts.TableBits, opts.BucketBits)
+			for seed := h.Nonces[0] + uint64(w); ; seed += uint64(opts.Workers) {
+				hh := h
+				hh.Nonces[0] = seed
+				if mineSeed(ctx, &hh, t, opts.NoncesPerSeed, &nonces) {
+					once.Do(func() {
+						found = hh
+						cancel()
+					})
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}(w)
+	}
+
+	if opts.Progress != nil {
+		go report(ctx, opts, &nonces)
+	}
+
+	wg.Wait()
+
+	if found.Nonces[1] == found.Nonces[2] {
+		return h, ctx.Err()
+	}
+	if err := pow.Verify(&found); err != nil {
+		return h, err
+	}
+
+	return found, nil
+}
+
+// mineSeed tries up to limit nonces for h.Nonces[0], storing the solution in
+// h on success.
+func mineSeed(ctx context.Context, h *coin.Header, t *table, limit uint64,
+	nonces *uint64) bool {
+
+	t.reset()
+	A, B := coin.AESHAM2{}.Ciphers(h)
+
+	for i := uint64(0); i < limit; i++ {
+		if i&0xfff == 0xfff {
+			atomic.AddUint64(nonces, 0x1000)
+			if ctx.Err() != nil {
+				return false
+			}
+		}
+
+		Ai := A.Encrypt(i)
+		Bi := B.Encrypt(i)
+		j, ok := t.swap(Ai.Sub(Bi), i)
+		if !ok {
+			continue
+		}
+
+		Aj := A.Encrypt(j)
+		Bj := B.Encrypt(j)
+		if coin.HammingCloseness(Ai, Aj, Bi, Bj) >= h.Difficulty {
+			h.Nonces[1] = i
+			h.Nonces[2] = j
+			return true
+		}
+	}
+
+	return false
+}
+
+// bucketBits picks the bucket width minimising the expected number of nonces
+// per solution.  Each nonce is compared against at most one earlier nonce, so
+// with b bucket bits and 2^t slots this is about
+//
+//	2^min(b,t) + 2^max(b-t,0) / p(b)
+//
+// where p(b) is the chance that a pair agreeing on its top b bits agrees on
+// at least difficulty bits overall.
+func bucketBits(difficulty uint64, tableBits uint) uint {
+	b, _ := bestBuckets(difficulty, tableBits)
+	return b
+}
+
+// Work is the expected number of nonces the miner evaluates per solution at
+// difficulty, with the default table size.  It follows the binomial tail of
+// Hamming closeness rather than 2^difficulty: about half of all pairs agree
+// on 64 bits already, so difficulties up to there cost next to nothing.
+func Work(difficulty uint64) float64 {
+	if difficulty >= uint64(len(work)) {
+		return math.Inf(+1)
+	}
+	workOnce.Do(func() {
+		for d := range work {
+			_, work[d] = bestBuckets(uint64(d), defaultTableBits)
+		}
+	})
+	return work[difficulty]
+}
+
+var (
+	work     [129]float64
+	workOnce sync.Once
+)
+
+// bestBuckets returns the bucket width with the lowest expected number of
+// nonces per solution, and that number.
+func bestBuckets(difficulty uint64, tableBits uint) (uint, float64) {
+	best, bestCost := uint(0), math.Inf(+1)
+	for b := uint(0); b <= 64 && uint64(b) <= difficulty; b++ {
+		p := binomialTail(128-b, int(difficulty)-int(b))
+		if p == 0 {
+			continue
+		}
+		fill, miss := float64(b), 0.0
+		if b > tableBits {
+			fill, miss = float64(tableBits), float64(b-tableBits)
+		}
+		cost := math.Exp2(fill) + math.Exp2(miss)/p
+		if cost < bestCost {
+			best, bestCost = b, cost
+		}
+	}
+	return best, bestCost
+}
+
+// binomialTail is P(X >= k) for X ~ Binomial(n, 1/2).
+func binomialTail(n uint, k int) float64 {
+	if k <= 0 {
+		return 1
+	}
+	tail, c := 0.0, 1.0
+	for i := 0; i <= int(n); i++ {
+		if i >= k {
+			tail += c
+		}
+		c = c * float64(int(n)-i) / float64(i+1)
+	}
+	return tail / math.Exp2(float64(n))
+}
+
+func report(ctx context.Context, opts Options, nonces *uint64) {
+	start := time.Now()
+	last := start
+	lastNonces := uint64(0)
+
+	tick := time.NewTicker(opts.ReportInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			n := atomic.LoadUint64(nonces)
+			opts.Progress(Stats{
+				Nonces:   n,
+				Elapsed:  now.Sub(start),
+				Hashrate: float64(n-lastNonces) / now.Sub(last).Seconds(),
+			})
+			last, lastNonces = now, n
+		}
+	}
+}
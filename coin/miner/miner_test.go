@@ -0,0 +1,152 @@
+package miner
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"../../coin"
+)
+
+var testBlock = coin.NewBlock([]string{"alice", "bob"})
+
+func testHeader(difficulty uint64) coin.Header {
+	return coin.Header{
+		MerkleRoot: coin.MerkleRoot(testBlock.Entries()),
+		Version:    1,
+		Difficulty: difficulty,
+		Timestamp:  time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC).UnixNano(),
+	}
+}
+
+func TestMine(t *testing.T) {
+	for _, difficulty := range []uint64{1, 64, 80} {
+		h := testHeader(difficulty)
+		opts := &Options{Workers: 2, TableBits: 16}
+
+		found, err := Mine(context.Background(), h, opts)
+		if err != nil {
+			t.Fatalf("difficulty %d: %v", difficulty, err)
+		}
+		if found.Nonces[1] == found.Nonces[2] {
+			t.Fatalf("difficulty %d: nonces 1 and 2 are both %d", difficulty, found.Nonces[1])
+		}
+		if found.Difficulty != difficulty || found.MerkleRoot != h.MerkleRoot {
+			t.Fatalf("difficulty %d: Mine changed more than the nonces", difficulty)
+		}
+		if err := found.Valid(testBlock); err != nil {
+			t.Fatalf("difficulty %d: mined header is not valid: %v", difficulty, err)
+		}
+	}
+}
+
+func TestMineCancel(t *testing.T) {
+	h := testHeader(128)
+	opts := &Options{Workers: 2, TableBits: 16}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Mine(ctx, h, opts)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Mine returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mine did not return after its context was cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Mine took %v to notice cancellation", elapsed)
+	}
+}
+
+func TestMineUnknownVersion(t *testing.T) {
+	h := testHeader(1)
+	h.Version = 255
+	if _, err := Mine(context.Background(), h, nil); err != coin.ErrUnkownVersion {
+		t.Fatalf("Mine returned %v, want %v", err, coin.ErrUnkownVersion)
+	}
+}
+
+func TestBucketBits(t *testing.T) {
+	if b := bucketBits(0, defaultTableBits); b != 0 {
+		t.Errorf("bucketBits(0) = %d, want 0", b)
+	}
+
+	last := uint(0)
+	for d := uint64(0); d <= 128; d++ {
+		b := bucketBits(d, defaultTableBits)
+		if uint64(b) > d || b > 64 {
+			t.Errorf("bucketBits(%d) = %d, out of range", d, b)
+		}
+		if b < last {
+			t.Errorf("bucketBits(%d) = %d, smaller than bucketBits(%d) = %d", d, b, d-1, last)
+		}
+		last = b
+	}
+
+	// Bucketing only pays off once random pairs rarely solve the puzzle,
+	// and at high difficulty the whole table is used.
+	if b := bucketBits(64, defaultTableBits); b != 0 {
+		t.Errorf("bucketBits(64) = %d, want 0", b)
+	}
+	if b := bucketBits(112, defaultTableBits); b < defaultTableBits {
+		t.Errorf("bucketBits(112) = %d, want at least %d", b, defaultTableBits)
+	}
+}
+
+func TestWork(t *testing.T) {
+	last := 0.0
+	for d := uint64(0); d <= 128; d++ {
+		w := Work(d)
+		if w < last || math.IsInf(w, 0) {
+			t.Errorf("Work(%d) = %g after Work(%d) = %g", d, w, d-1, last)
+		}
+		last = w
+	}
+
+	// Random pairs solve low difficulties, and once the table is full each
+	// step costs more than the last, unlike 2^difficulty.
+	if w := Work(32); w > 3 {
+		t.Errorf("Work(32) = %g, want at most 3", w)
+	}
+	step := 1.0
+	for d := uint64(104); d < 128; d++ {
+		r := Work(d+1) / Work(d)
+		if r <= step {
+			t.Errorf("Work(%d) / Work(%d) = %g, not more than the step before", d+1, d, r)
+		}
+		step = r
+	}
+	if !math.IsInf(Work(129), +1) {
+		t.Errorf("Work(129) = %g, want +Inf", Work(129))
+	}
+}
+
+func TestBinomialTail(t *testing.T) {
+	tests := []struct {
+		n    uint
+		k    int
+		want float64
+	}{
+		{0, 0, 1},
+		{4, -1, 1},
+		{4, 5, 0},
+		{2, 1, 0.75},
+		{4, 2, 11.0 / 16},
+		{128, 64, 0.5 + 0.5*0.07037}, // P(X = 64) is about 0.07037
+	}
+	for _, test := range tests {
+		if got := binomialTail(test.n, test.k); math.Abs(got-test.want) > 1e-4 {
+			t.Errorf("binomialTail(%d, %d) = %v, want %v", test.n, test.k, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package miner
+
+import "../../coin"
+
+// table is a direct-mapped bucket table.  The top slotBits bits of a key pick
+// the slot and the following tagBits bits are kept as a tag, so two keys
+// match when their top slotBits+tagBits bits agree.
+type table struct {
+	slots    []slot
+	slotBits uint
+	tagBits  uint
+}
+
+type slot struct {
+	nonce uint32 // nonce+1, or 0 when empty
+	tag   uint32
+}
+
+func newTable(slotBits, bucketBits uint) *table {
+	return &table{
+		slots:    make([]slot, 1<<slotBits),
+		slotBits: slotBits,
+		tagBits:  bucketBits - slotBits,
+	}
+}
+
+func (t *table) reset() {
+	for i := range t.slots {
+		t.slots[i] = slot{}
+	}
+}
+
+// swap stores nonce under key and returns the nonce previously stored there,
+// if its key matched.
+func (t *table) swap(key coin.Uint128, nonce uint64) (uint64, bool) {
+	var index uint64
+	if t.slotBits > 0 {
+		index = key.Hi >> (64 - t.slotBits)
+	}
+	var tag uint32
+	if t.tagBits > 0 {
+		tag = uint32(key.Hi << t.slotBits >> (64 - t.tagBits))
+	}
+
+	s := &t.slots[index]
+	old, match := s.nonce, s.nonce != 0 && s.tag == tag
+	s.nonce, s.tag = uint32(nonce+1), tag
+
+	return uint64(old) - 1, match
+}
@@ -0,0 +1,40 @@
+package coin
+
+import (
+	"fmt"
+)
+
+// PoW is a proof-of-work puzzle.  Every header version is bound to exactly one
+// puzzle, so a new puzzle ships by registering it under a new version rather
+// than by changing Header.
+type PoW interface {
+	// Name is a short human readable name for the puzzle, e.g. "AESHAM2".
+	Name() string
+
+	// Verify checks that the nonces in h solve the puzzle at h.Difficulty.
+	Verify(h *Header) error
+
+	// Mine searches for nonces that solve the puzzle at h.Difficulty and
+	// stores them in h.  All other fields of h are left untouched.
+	Mine(h *Header) error
+}
+
+var powRegistry = make(map[uint8]PoW)
+
+// RegisterPoW binds p to header version.  It is meant to be called from init
+// functions and panics if version already has a puzzle.
+func RegisterPoW(version uint8, p PoW) {
+	if old, ok := powRegistry[version]; ok {
+		panic(fmt.Sprintf("coin: version %d already uses PoW %s", version, old.Name()))
+	}
+	powRegistry[version] = p
+}
+
+// LookupPoW returns the puzzle registered for header version.
+func LookupPoW(version uint8) (PoW, error) {
+	p, ok := powRegistry[version]
+	if !ok {
+		return nil, ErrUnkownVersion
+	}
+	return p, nil
+}
@@ -0,0 +1,96 @@
+package coin
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+)
+
+// SignedPayload is the contents of a version 2 block: the Merkle tree commits
+// Entries and Team, and Signature is Team's signature over the header's
+// ParentID and MerkleRoot, so the block is attributable to Team.
+type SignedPayload struct {
+	Team      string   `json:"team"`
+	Entries   []string `json:"entries"`
+	Signature []byte   `json:"signature"`
+}
+
+// TeamKeys resolves the team of a signed payload to its public key.
+type TeamKeys interface {
+	TeamKey(team string) (ed25519.PublicKey, error)
+}
+
+// TeamEntryPrefix marks the last leaf of a version 2 Merkle tree, which names
+// the team.  Committing the team in the root binds the proof of work to it, so
+// another team cannot re-sign the same header as its own.
+const TeamEntryPrefix = "team:"
+
+var (
+	ErrPayloadEncoding  = errors.New("malformed signed payload")
+	ErrUnknownTeam      = errors.New("unknown team or team has no key")
+	ErrInvalidSignature = errors.New("invalid team signature")
+)
+
+// Payload decodes a version 2 block.
+func (b Block) Payload() (*SignedPayload, error) {
+	p := new(SignedPayload)
+	if err := json.Unmarshal([]byte(b), p); err != nil {
+		return nil, ErrPayloadEncoding
+	}
+	return p, nil
+}
+
+// MerkleEntries returns the leaves of a version 2 Merkle tree: Entries, then
+// the team entry.
+func (p *SignedPayload) MerkleEntries() []string {
+	leaves := make([]string, 0, len(p.Entries)+1)
+	leaves = append(leaves, p.Entries...)
+	return append(leaves, TeamEntryPrefix+p.Team)
+}
+
+// NewSignedBlock sets the Merkle root of version 2 header h to commit entries
+// and returns the block signed by team with key.
+func NewSignedBlock(h *Header, team string, entries []string, key ed25519.PrivateKey) (Block, error) {
+	if h.Version != 2 {
+		return "", ErrUnkownVersion
+	}
+
+	p := &SignedPayload{Team: team, Entries: entries}
+	h.MerkleRoot = MerkleRoot(p.MerkleEntries())
+	p.Signature = ed25519.Sign(key, signedMessage(h))
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return Block(b), nil
+}
+
+// signedMessage is what a team signs: ParentID followed by MerkleRoot.
+func signedMessage(h *Header) []byte {
+	msg := make([]byte, 0, len(h.ParentID)+len(h.MerkleRoot))
+	msg = append(msg, h.ParentID[:]...)
+	return append(msg, h.MerkleRoot[:]...)
+}
+
+// validSignature checks the signature of a version 2 block against its
+// team's key in keys.  Without keys, no version 2 block is valid.
+func (h *Header) validSignature(b Block, keys TeamKeys) error {
+	p, err := b.Payload()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return ErrUnknownTeam
+	}
+
+	key, err := keys.TeamKey(p.Team)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return ErrUnknownTeam
+	}
+	if !ed25519.Verify(key, signedMessage(h), p.Signature) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
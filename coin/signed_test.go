@@ -0,0 +1,95 @@
+package coin
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+)
+
+type testKeys map[string]ed25519.PublicKey
+
+func (k testKeys) TeamKey(team string) (ed25519.PublicKey, error) {
+	if key, ok := k[team]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownTeam
+}
+
+func newTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// signedBlock mines a version 2 block signed by team with key.
+func signedBlock(t *testing.T, team string, key ed25519.PrivateKey) (Header, Block) {
+	h := Header{Version: 2, Difficulty: 1}
+	copy(h.ParentID[:], "parent")
+	b, err := NewSignedBlock(&h, team, []string{"alice", "bob"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.MineBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	return h, b
+}
+
+func TestSignedBlock(t *testing.T) {
+	publicA, privateA := newTestKey(t)
+	publicB, privateB := newTestKey(t)
+	keys := testKeys{"a": publicA, "b": publicB}
+
+	h, b := signedBlock(t, "a", privateA)
+	if err := h.ValidLimit(b, MAX_BLOCK_SIZE, keys); err != nil {
+		t.Fatalf("signed block: %v", err)
+	}
+	if err := h.Valid(b); err != ErrUnknownTeam {
+		t.Errorf("without keys: got %v, want %v", err, ErrUnknownTeam)
+	}
+	if err := h.ValidLimit(b, MAX_BLOCK_SIZE, testKeys{"a": publicB}); err != ErrInvalidSignature {
+		t.Errorf("wrong key: got %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := h.ValidLimit(b, MAX_BLOCK_SIZE, testKeys{}); err != ErrUnknownTeam {
+		t.Errorf("unregistered team: got %v, want %v", err, ErrUnknownTeam)
+	}
+
+	// Team b re-signs team a's header as its own
+	p, err := b.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Team = "b"
+	p.Signature = ed25519.Sign(privateB, signedMessage(&h))
+	stolen, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ValidLimit(Block(stolen), MAX_BLOCK_SIZE, keys); err != ErrInvalidMerkleRoot {
+		t.Errorf("re-signed by another team: got %v, want %v", err, ErrInvalidMerkleRoot)
+	}
+}
+
+func TestSignedMerkleEntries(t *testing.T) {
+	_, private := newTestKey(t)
+	h, b := signedBlock(t, "a", private)
+
+	entries, err := MerkleEntries(2, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice", "bob", TeamEntryPrefix + "a"}
+	if len(entries) != len(want) {
+		t.Fatalf("entries %q, want %q", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Fatalf("entries %q, want %q", entries, want)
+		}
+	}
+	if MerkleRoot(entries) != h.MerkleRoot {
+		t.Error("header does not commit the Merkle entries")
+	}
+}
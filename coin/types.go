@@ -1,20 +1,10 @@
 package coin
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/big"
-	"strings"
-)
-
-var (
-	bigOne = new(big.Int).SetUint64(1)
-	bigTwo = new(big.Int).SetUint64(2)
 )
 
 var (
@@ -72,66 +62,22 @@ const MAX_BLOCK_SIZE = 1000
 type Block string
 
 func (h *Header) Sum() Hash {
-	b := make([]byte, 32+32+8+8+8+8+8+1)
-	offset := copy(b, h.ParentID[:])
-	offset += copy(b[offset:], h.MerkleRoot[:])
-	binary.BigEndian.PutUint64(b[offset:], h.Difficulty)
-	offset += 8
-	binary.BigEndian.PutUint64(b[offset:], uint64(h.Timestamp))
-	offset += 8
-	for i, n := range h.Nonces {
-		binary.BigEndian.PutUint64(b[offset+8*i:], n)
-	}
-	b[offset+24] = h.Version
-
-	return sha256.Sum256(b)
-}
-
-func (h *Header) computeAAndB() (cipher.Block, cipher.Block) {
-	b := make([]byte, 32+32+8+8+8+1)
-	copy(b, h.ParentID[:])
-	copy(b[32:], h.MerkleRoot[:])
-	binary.BigEndian.PutUint64(b[32+32:], h.Difficulty)
-	binary.BigEndian.PutUint64(b[32+32+8:], uint64(h.Timestamp))
-	binary.BigEndian.PutUint64(b[32+32+8+8:], h.Nonces[0])
-	b[32+32+8+8+8] = h.Version
-	seed := sha256.Sum256(b)
-	seed2 := sha256.Sum256(seed[:])
-	A, _ := aes.NewCipher(seed[:])
-	B, _ := aes.NewCipher(seed2[:])
-	return A, B
-}
+	var b [HeaderSize]byte
+	h.putBinary(b[:])
 
-func computeAES(block cipher.Block, m uint64) *big.Int {
-	blockM := make([]byte, 16)
-	binary.BigEndian.PutUint64(blockM, 0)
-	binary.BigEndian.PutUint64(blockM[8:], m)
-	blockC := make([]byte, 16)
-	block.Encrypt(blockC, blockM)
-	c := new(big.Int).SetBytes(blockC[:])
-	return c
+	return sha256.Sum256(b[:])
 }
 
-func computeHammingCloseness(Ai, Aj, Bi, Bj *big.Int) uint64 {
-	int128 := new(big.Int).SetUint64(128)
-	mod := new(big.Int).SetUint64(2)
-	mod.Exp(mod, int128, nil)
-
-	AiBj := new(big.Int).SetUint64(0)
-	AiBj.Add(Ai, Bj)
-	AiBj.Mod(AiBj, mod)
-	AjBi := new(big.Int).SetUint64(0)
-	AjBi.Add(Aj, Bi)
-	AjBi.Mod(AjBi, mod)
-
-	xor := new(big.Int).SetUint64(0)
-	xor.Xor(AiBj, AjBi)
-	s := fmt.Sprintf("%0128b", xor)
-	return uint64(strings.Count(s, "0"))
+// Valid checks a version 0 or 1 block.  Version 2 blocks need the team keys
+// passed to ValidLimit.
+func (h *Header) Valid(b Block) error {
+	return h.ValidLimit(b, MAX_BLOCK_SIZE, nil)
 }
 
-func (h *Header) Valid(b Block) error {
-	if len(b) > MAX_BLOCK_SIZE {
+// ValidLimit is Valid for networks with a block size limit other than
+// MAX_BLOCK_SIZE, verifying version 2 signatures against keys.
+func (h *Header) ValidLimit(b Block, maxBlockSize int, keys TeamKeys) error {
+	if len(b) > maxBlockSize {
 		return ErrBlockSize
 	}
 	// Header first validation
@@ -144,57 +90,71 @@ func (h *Header) Valid(b Block) error {
 		return err
 	}
 
+	// Ensure the team signed it
+	if h.Version == 2 {
+		if err := h.validSignature(b, keys); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (h *Header) validPoW() error {
-	if h.Nonces[1] == h.Nonces[2] {
-		return ErrInvalidPoW
+	pow, err := LookupPoW(h.Version)
+	if err != nil {
+		return err
 	}
 
-	A, B := h.computeAAndB()
-	Ai := computeAES(A, h.Nonces[1])
-	Aj := computeAES(A, h.Nonces[2])
-	Bi := computeAES(B, h.Nonces[1])
-	Bj := computeAES(B, h.Nonces[2])
-	d := computeHammingCloseness(Ai, Aj, Bi, Bj)
+	return pow.Verify(h)
+}
 
-	if d < h.Difficulty {
-		return ErrInvalidPoW
+func (h *Header) validMerkleTree(b Block) error {
+	root, err := computeMerkleTree(h.Version, b)
+	if err != nil {
+		return err
+	}
+	if h.MerkleRoot != root {
+		return ErrInvalidMerkleRoot
 	}
 
 	return nil
 }
 
-func (h *Header) validMerkleTree(b Block) error {
-	if h.Version == 0 {
-		if h.MerkleRoot == computeMerkleTreeV0(b) {
-			return nil
+func computeMerkleTree(version uint8, b Block) (Hash, error) {
+	switch version {
+	case 0:
+		return computeMerkleTreeV0(b), nil
+	case 1, 2:
+		entries, err := MerkleEntries(version, b)
+		if err != nil {
+			return Hash{}, err
 		}
+		return MerkleRoot(entries), nil
 	}
 
-	return ErrUnkownVersion
+	return Hash{}, ErrUnkownVersion
 }
 
 func computeMerkleTreeV0(b Block) Hash {
 	return sha256.Sum256([]byte(b))
 }
 
-func (h *Header) MineBlock(b Block) {
-	h.MerkleRoot = computeMerkleTreeV0(b)
-
-	A, B := h.computeAAndB()
-	aesA := make([]*big.Int, 0)
-	aesB := make([]*big.Int, 0)
-	for i := uint64(0); ; i++ {
-		aesA = append(aesA, computeAES(A, i))
-		aesB = append(aesB, computeAES(B, i))
-		for j := uint64(0); j < i; j++ {
-			if computeHammingCloseness(aesA[i], aesA[j], aesB[i], aesB[j]) >= h.Difficulty {
-				h.Nonces[1] = i
-				h.Nonces[2] = j
-				return
-			}
-		}
+// SetMerkleRoot commits b into h according to h.Version.
+func (h *Header) SetMerkleRoot(b Block) (err error) {
+	h.MerkleRoot, err = computeMerkleTree(h.Version, b)
+	return err
+}
+
+func (h *Header) MineBlock(b Block) error {
+	pow, err := LookupPoW(h.Version)
+	if err != nil {
+		return err
 	}
+
+	if err := h.SetMerkleRoot(b); err != nil {
+		return err
+	}
+
+	return pow.Mine(h)
 }
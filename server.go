@@ -2,18 +2,131 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log"
+	"os"
 	"runtime"
+	"time"
 
 	"./server"
 )
 
 var (
-	addr = flag.String("addr", ":8080", "http service address")
+	addr    = flag.String("addr", ":8080", "http service address")
+	config  = flag.String("config", "", "JSON config file with network profiles")
+	network = flag.String("network", "", "network profile: mainnet, classroom-testnet, regtest, or one from -config")
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [flags] [command]
+
+commands:
+  serve      run the blockchain server (default)
+  migrate    upgrade or roll back the blockchain database schema
+  verify-scores
+             recompute team scores from scratch and report drift
+  genesis    mine a genesis block for the network and print it
+  simulate   compare block times of the difficulty algorithms
+
+flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	flag.Usage = usage
 	flag.Parse()
 
-	server.Start(*addr)
+	params, err := server.LoadChainParams(*config, *network)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		err = serve(params)
+	case "migrate":
+		err = migrate(params, flag.Args()[1:])
+	case "verify-scores":
+		err = verifyScores(flag.Args()[1:])
+	case "genesis":
+		err = genesis(params, flag.Args()[1:])
+	case "simulate":
+		err = simulate(params, flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serve(params *server.ChainParams) error {
+	opts, err := server.LoadOptions(*config)
+	if err != nil {
+		return err
+	}
+
+	return server.Start(*addr, params, opts)
+}
+
+func migrate(params *server.ChainParams, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", server.SchemaVersion, "schema version to migrate to")
+	rollback := fs.Bool("rollback", false, "roll back to the schema before this server's (same as -to=SchemaVersion-1)")
+	fs.Parse(args)
+
+	if *rollback {
+		*to = server.SchemaVersion - 1
+	}
+
+	return server.Migrate(server.BlockchainPath, params, *to)
+}
+
+func verifyScores(args []string) error {
+	fs := flag.NewFlagSet("verify-scores", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "rewrite the stored scores with the recomputed ones")
+	fs.Parse(args)
+
+	drift, err := server.VerifyScores(server.BlockchainPath, *fix, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if drift > 0 && !*fix {
+		return fmt.Errorf("%d score entries drifted, rerun with -fix to repair", drift)
+	}
+	fmt.Printf("%d score entries drifted\n", drift)
+
+	return nil
+}
+
+func genesis(params *server.ChainParams, args []string) error {
+	fs := flag.NewFlagSet("genesis", flag.ExitOnError)
+	ts := fs.String("time", "", "genesis timestamp in RFC 3339 format (default now)")
+	fs.Parse(args)
+
+	t := time.Now()
+	if *ts != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, *ts); err != nil {
+			return err
+		}
+	}
+
+	return server.WriteGenesis(os.Stdout, params, t)
+}
+
+func simulate(params *server.ChainParams, args []string) error {
+	var o server.SimOptions
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	fs.IntVar(&o.Blocks, "blocks", 2000, "number of blocks to simulate")
+	fs.Int64Var(&o.Seed, "seed", 1, "random seed")
+	fs.Float64Var(&o.Headroom, "headroom", 4, "starting hashpower, in doublings of the work at minimum difficulty")
+	fs.Float64Var(&o.Drop, "drop", 16, "factor by which hashpower drops halfway through")
+	fs.Parse(args)
+
+	_, err := server.Simulate(params, o, os.Stdout)
+	return err
 }
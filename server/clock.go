@@ -0,0 +1,49 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the blockchain the current time, so consensus rules can run
+// against simulated time.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// SimClock is a Clock that only moves when told to.
+type SimClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func NewSimClock(t time.Time) *SimClock {
+	return &SimClock{now: t}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t.
+func (c *SimClock) Set(t time.Time) {
+	c.Lock()
+	c.now = t
+	c.Unlock()
+}
+
+// Advance moves the clock forward by d.
+func (c *SimClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
@@ -1,57 +1,64 @@
 package server
 
 import (
-	"encoding/json"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"../coin"
-	db "github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
+	"../coin/miner"
 )
 
 const (
-	targetBlockInterval      = 10 * 60 * 1000 * 1000 * 1000      // 10 minutes
-	difficultyRetargetLength = 24 * 60 * 60 * 1000 * 1000 * 1000 // 1 day
-	difficultyRetargetWindow = uint64(difficultyRetargetLength / targetBlockInterval)
-	maxClockDrift            = 2 * 60 * 1000 * 1000 * 1000 // 2 minutes
-
 	BlockchainPath = "blockchain.db"
 
 	HeaderBucket = "HEADER-"
 	BlockBucket  = "BLOCK-"
-
-	MinimumDifficulty = uint64(86)
+	HeightBucket = "HEIGHT-"
+	HeadKey      = "HEAD"
 )
 
-var genesisHeader coin.Header
+// No two 128-bit values agree in more than 128 bits
+const maxDifficulty = 128
 
 var (
 	ErrHeaderExhausted = errors.New("exhausted all possible nonces")
 	ErrClockDrift      = errors.New("excessive clock drift")
 	ErrSpamHeader      = errors.New("header previously submitted")
 	ErrDifficulty      = errors.New("invalid difficulty")
+	ErrChainParams     = errors.New("database was created with different chain params")
+	ErrGenesis         = errors.New("database has a different genesis block")
+	ErrMedianTime      = errors.New("timestamp is not after the median time of recent blocks")
+	ErrOrphan          = errors.New("parent not found, holding block as an orphan")
 )
 
 type (
 	blockchain struct {
 		sync.Mutex
 
+		params         *ChainParams
+		clock          Clock
 		head           processedHeader
 		currDifficulty uint64
 
-		scores       map[string]int
-		mainscores   map[string]int
-		everscores   map[string]int
-		heightToHash map[uint64]coin.Hash
+		scores     map[string]int
+		mainscores map[string]int
+		everscores map[string]int
+
+		spam    *spamFilter
+		orphans *orphanPool
 
-		spam map[coin.Hash]struct{}
+		// Closed, and replaced, whenever the main chain moves
+		headChanged chan struct{}
 
-		db *db.DB
+		events *eventHub
+
+		store ChainStore
 	}
 
 	processedHeader struct {
@@ -60,30 +67,55 @@ type (
 		IsMainChain     bool        `json:"ismainchain"`
 		EverMainChain   bool        `json:"evermainchain"`
 		TotalDifficulty uint64      `json:"totaldiff"`
+
+		// Difficulty required of this header when it was accepted
+		TargetDifficulty uint64 `json:"targetdiff"`
 	}
 )
 
-func newBlockchain() (*blockchain, error) {
+func newBlockchain(store ChainStore, params *ChainParams,
+	genesis *compositeBlock, clock Clock) (*blockchain, error) {
+
+	if err := verifyGenesis(params, genesis); err != nil {
+		return nil, err
+	}
+
 	bc := &blockchain{
-		currDifficulty: MinimumDifficulty,
-		spam:           make(map[coin.Hash]struct{}),
+		params:         params,
+		clock:          clock,
+		currDifficulty: params.MinimumDifficulty,
+		orphans:        newOrphanPool(),
+		headChanged:    make(chan struct{}),
+		events:         newEventHub(clock.Now()),
+		store:          store,
+	}
+
+	if err := checkSchema(store); err != nil {
+		return nil, err
 	}
-	bc.initDB()
 
 	if err := bc.loadScores(); err != nil {
 		return nil, err
 	}
 
-	if err := bc.loadHeightToHash(); err != nil {
+	spam, err := loadSpamFilter(store, clock.Now())
+	if err != nil {
 		return nil, err
 	}
+	bc.spam = spam
 
-	// Mine genesis block if necessary
-	if _, ok := bc.heightToHash[0]; !ok {
-		log.Println("Mining genesis block...")
-		if err := bc.mineGenesisBlock(); err != nil {
+	if err := bc.loadHead(); err != nil {
+		return nil, err
+	}
+
+	// Add genesis block if necessary
+	if bc.empty() {
+		log.Printf("Adding %s genesis block %s\n", params.Name, genesis.Header.Sum())
+		if err := bc.addGenesis(genesis); err != nil {
 			return nil, err
 		}
+	} else if err := bc.checkGenesis(genesis); err != nil {
+		return nil, err
 	}
 
 	return bc, nil
@@ -93,165 +125,127 @@ func newBlockchain() (*blockchain, error) {
  * Initialization
  */
 
-func (bc *blockchain) initDB() {
-	bcdb, err := db.OpenFile(BlockchainPath, nil)
-	if err != nil {
-		log.Println(err)
-		panic("unable to open blockchain database")
-	}
-	bc.db = bcdb
-}
-
-func (bc *blockchain) mineGenesisBlock() error {
-	msg := "Never roll your own crypto"
-	b := coin.Block(msg)
-
-	genesisHeader = coin.Header{
-		Difficulty: MinimumDifficulty,
-		Timestamp:  time.Now().UnixNano(),
-	}
-	genesisHeader.MineBlock(b)
-
-	return bc.AddBlock(genesisHeader, b)
-}
-
-func (bc *blockchain) loadScores() error {
-	bc.scores = make(map[string]int)
-	bc.mainscores = make(map[string]int)
-	bc.everscores = make(map[string]int)
-
-	// Iterate over all headers, add to score if version 0
-	iter := bc.db.NewIterator(util.BytesPrefix([]byte(HeaderBucket)), nil)
-	for iter.Next() {
-		// Load header
-		headerBytes := iter.Value()
-		var pheader processedHeader
-		if err := json.Unmarshal(headerBytes, &pheader); err != nil {
-			return err
-		}
-
-		// Load block data and convert to string
-		teamname, err := bc.getBlock(pheader.Header.Sum())
-		if err != nil {
-			continue
-		}
-
-		// Increment total score
-		bc.scores[teamname]++
-
-		// Increment main chain score
-		if pheader.IsMainChain {
-			bc.mainscores[teamname]++
-		}
-
-		// Increment ever in main chain score
-		if pheader.EverMainChain {
-			bc.everscores[teamname]++
-		}
+func (bc *blockchain) loadHead() error {
+	id, err := bc.store.Get([]byte(HeadKey))
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func (bc *blockchain) loadHeightToHash() error {
-	bc.heightToHash = make(map[uint64]coin.Hash)
-
-	maxDifficulty := uint64(0)
-	iter := bc.db.NewIterator(util.BytesPrefix([]byte(HeaderBucket)), nil)
-	for iter.Next() {
-		// Unmarshal processedHeader
-		b := iter.Value()
-		var pheader processedHeader
-		err := json.Unmarshal(b, &pheader)
-		if err != nil {
-			return err
-		}
-
-		// Add to heightToHash map if header is in main chain
-		if pheader.IsMainChain {
-			id := pheader.Header.Sum()
-			bc.heightToHash[pheader.BlockHeight] = id
-
-			if pheader.TotalDifficulty > maxDifficulty {
-				maxDifficulty = pheader.TotalDifficulty
-				bc.head = pheader
-			}
-		}
+	var headID coin.Hash
+	copy(headID[:], id)
+	head, err := bc.getHeader(headID)
+	if err != nil {
+		return err
 	}
+	bc.head = *head
 
 	// Calculate Difficulty
-	diff, err := bc.computeDifficulty(bc.head.Header.Sum())
+	diff, err := bc.computeDifficulty(headID)
 	if err != nil {
 		return err
 	}
 	bc.currDifficulty = diff
 
+	close(bc.headChanged)
+	bc.headChanged = make(chan struct{})
+
 	return nil
 }
 
+// empty reports whether the chain is still waiting for its genesis block.
+func (bc *blockchain) empty() bool {
+	return !bc.head.IsMainChain
+}
+
 /*
  * Consensus Set
  */
 
 func (bc *blockchain) AddBlock(h coin.Header, b coin.Block) error {
-	if h.Difficulty < MinimumDifficulty {
+	if h.Difficulty < bc.params.MinimumDifficulty {
 		return ErrDifficulty
 	}
 
-	// Check that timestamp is within 2 minutes of now
-	diff := int64(h.Timestamp) - time.Now().UnixNano()
-	if diff > maxClockDrift || diff < -maxClockDrift {
+	// Check that timestamp is within MaxClockDrift of now
+	drift := time.Duration(h.Timestamp - bc.clock.Now().UnixNano())
+	maxDrift := time.Duration(bc.params.MaxClockDrift)
+	if drift > maxDrift || drift < -maxDrift {
 		return ErrClockDrift
 	}
 
+	// Only credit well formed team lists
+	if _, err := canonicalTeam(&h, b); err != nil {
+		return err
+	}
+
+	// Check spam filter before the expensive checks
+	id := h.Sum()
+	if err := bc.spam.check(id, bc.clock.Now()); err != nil {
+		return err
+	}
+
 	// Only process valid blocks
-	if err := h.Valid(b); err != nil {
+	if err := h.ValidLimit(b, bc.params.MaxBlockSize, bc); err != nil {
+		if err == coin.ErrInvalidPoW {
+			bc.spam.add(id, spamInvalidPoW, bc.clock.Now())
+		}
 		return err
 	}
 
 	bc.Lock()
 	defer bc.Unlock()
 
-	// Check spam filter
-	id := h.Sum()
-	if _, ok := bc.spam[id]; ok {
+	// Check database and orphan pool for existing header.  Only stored
+	// headers are remembered as spam: an orphan may still be dropped from
+	// the pool, and must be accepted again when resent.
+	if _, err := bc.getHeader(id); err == nil {
+		bc.spam.add(id, spamDuplicate, bc.clock.Now())
 		return ErrSpamHeader
 	}
-
-	// Check database for existing header
-	if _, err := bc.getHeader(id); err == nil {
-		bc.spam[id] = struct{}{}
+	if bc.orphans.has(id) {
 		return ErrSpamHeader
 	}
 
+	// Hold on to blocks that arrive before their parent
+	if _, err := bc.getHeader(h.ParentID); err == ErrNotFound {
+		bc.orphans.add(h, b, bc.clock.Now())
+		return ErrOrphan
+	}
+
 	// Build processedHeader
 	ph, err := bc.processHeader(h)
 	if err != nil {
 		return err
 	}
 
-	err = bc.extendChain(ph, b)
-	if err != nil {
-		// Attempt to fix up scores, if we failed to extend
-		bc.loadScores()
+	if err := bc.extendChain(ph, b); err != nil {
+		return err
 	}
-	return err
+
+	bc.connectOrphans(id)
+	return nil
 }
 
 func (bc *blockchain) extendChain(ph *processedHeader, b coin.Block) error {
-	batch := &db.Batch{}
+	batch := bc.store.NewBatch()
+	changes := make(scoreChanges)
+	oldHead, oldDifficulty := bc.head, bc.currDifficulty
+	reverted := 0
 
 	if ph.BlockHeight == 0 {
 		ph.IsMainChain = true
 		ph.EverMainChain = true
 
 	} else if ph.TotalDifficulty > bc.head.TotalDifficulty {
-		if err := bc.forkMainChain(ph, b, batch); err != nil {
+		var err error
+		if reverted, err = bc.forkMainChain(ph, b, batch, changes); err != nil {
 			return err
 		}
 	}
 
-	headerBytes, err := json.Marshal(ph)
+	headerBytes, err := ph.MarshalBinary()
 	if err != nil {
 		return err
 	}
@@ -262,39 +256,55 @@ func (bc *blockchain) extendChain(ph *processedHeader, b coin.Block) error {
 	bid := bucket(BlockBucket, id)
 	batch.Put(hid, headerBytes)
 	batch.Put(bid, []byte(b))
+	if ph.IsMainChain {
+		batch.Put(heightKey(ph.BlockHeight), id[:])
+		batch.Put([]byte(HeadKey), id[:])
+	}
 
-	teamname := string(b)
-	bc.scores[teamname]++
+	teamname := bc.scoreName(&ph.Header, string(b))
+	changes.add(scoreTotal, teamname, 1)
 	if ph.IsMainChain {
-		bc.mainscores[teamname]++
+		changes.add(scoreMain, teamname, 1)
 	}
 	if ph.EverMainChain {
-		bc.everscores[teamname]++
+		changes.add(scoreEver, teamname, 1)
 	}
+	bc.stageScores(changes, batch)
 
-	if err := bc.db.Write(batch, nil); err != nil {
+	if err := bc.store.Write(batch); err != nil {
 		return err
 	}
+	bc.applyScores(changes)
 
 	headerTime := time.Unix(0, ph.Header.Timestamp)
 	if !ph.IsMainChain {
 		log.Printf("[Side Chain] height: %d diff: %d id: %s time: %s\n",
 			ph.BlockHeight, ph.TotalDifficulty, ph.Header.Sum(), headerTime)
+		bc.publishBlock(ph, teamname, oldHead, reverted, oldDifficulty, changes)
 		return nil
 	}
 
-	if err := bc.loadHeightToHash(); err != nil {
+	bc.head = *ph
+	diff, err := bc.computeDifficulty(id)
+	if err != nil {
 		return err
 	}
+	bc.currDifficulty = diff
+
+	close(bc.headChanged)
+	bc.headChanged = make(chan struct{})
 
 	log.Printf("[Main Chain] height: %d diff: %d id: %s time: %s\n",
 		ph.BlockHeight, ph.TotalDifficulty, ph.Header.Sum(), headerTime)
+	bc.publishBlock(ph, teamname, oldHead, reverted, oldDifficulty, changes)
 
 	return nil
 }
 
+// forkMainChain makes ph's branch the main chain, returning how many blocks
+// it reverted from the old one.
 func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
-	batch *db.Batch) error {
+	batch StoreBatch, changes scoreChanges) (int, error) {
 
 	// Find most recent fork with main chain, starting from ph.  Memoize
 	// intermediate headers
@@ -303,7 +313,7 @@ func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
 	for {
 		tempph, err := bc.getHeader(sideph.Header.ParentID)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		sideph = *tempph
 
@@ -317,14 +327,14 @@ func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
 	// Memoize headers in main fork
 	mainheaders := []processedHeader{}
 	for i := bc.head.BlockHeight; i > sideph.BlockHeight; i-- {
-		id, ok := bc.heightToHash[i]
-		if !ok {
-			return fmt.Errorf("block at height %d not found in heightToHash map", i)
+		id, err := bc.getHeightHash(i)
+		if err != nil {
+			return 0, fmt.Errorf("block at height %d not found in height index: %s", i, err)
 		}
 
 		mainph, err := bc.getHeader(id)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		mainheaders = append([]processedHeader{*mainph}, mainheaders...)
@@ -334,22 +344,20 @@ func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
 	for _, mph := range mainheaders {
 		mph.IsMainChain = false
 
-		headerBytes, err := json.Marshal(mph)
+		headerBytes, err := mph.MarshalBinary()
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		id := bucket(HeaderBucket, mph.Header.Sum())
 		batch.Put(id, headerBytes)
+		batch.Delete(heightKey(mph.BlockHeight))
 
-		teamname, err := bc.getBlock(mph.Header.Sum())
+		block, err := bc.getBlock(mph.Header.Sum())
 		if err != nil {
 			continue
 		}
-		bc.mainscores[teamname]--
-		if bc.mainscores[teamname] == 0 {
-			delete(bc.mainscores, teamname)
-		}
+		changes.add(scoreMain, bc.scoreName(&mph.Header, block), -1)
 	}
 
 	// Apply side chain
@@ -359,21 +367,24 @@ func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
 		sph.IsMainChain = true
 		sph.EverMainChain = true
 
-		headerBytes, err := json.Marshal(sph)
+		headerBytes, err := sph.MarshalBinary()
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		hid := bucket(HeaderBucket, sph.Header.Sum())
+		sid := sph.Header.Sum()
+		hid := bucket(HeaderBucket, sid)
 		batch.Put(hid, headerBytes)
+		batch.Put(heightKey(sph.BlockHeight), sid[:])
 
-		teamname, err := bc.getBlock(sph.Header.Sum())
+		block, err := bc.getBlock(sph.Header.Sum())
 		if err != nil {
 			continue
 		}
-		bc.mainscores[teamname]++
+		teamname := bc.scoreName(&sph.Header, block)
+		changes.add(scoreMain, teamname, 1)
 		if !wasEverMainChain {
-			bc.everscores[teamname]++
+			changes.add(scoreEver, teamname, 1)
 		}
 	}
 
@@ -384,7 +395,7 @@ func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
 	ph.IsMainChain = true
 	ph.EverMainChain = true
 
-	return nil
+	return len(mainheaders), nil
 }
 
 /*
@@ -392,8 +403,8 @@ func (bc *blockchain) forkMainChain(ph *processedHeader, b coin.Block,
  */
 
 func (bc *blockchain) computeDifficulty(id coin.Hash) (uint64, error) {
-	if len(bc.heightToHash) == 0 {
-		return MinimumDifficulty, nil
+	if bc.empty() {
+		return bc.params.MinimumDifficulty, nil
 	}
 
 	header, err := bc.getHeader(id)
@@ -401,24 +412,35 @@ func (bc *blockchain) computeDifficulty(id coin.Hash) (uint64, error) {
 		return 0, err
 	}
 
+	if bc.params.DifficultyAlgorithm == DifficultyLWMA {
+		window, err := lwmaWindow(header, bc.params.LWMAWindow, func(ph *processedHeader) (*processedHeader, error) {
+			return bc.getHeader(ph.Header.ParentID)
+		})
+		if err != nil {
+			return 0, err
+		}
+		return lwmaTargetDifficulty(bc.params, window), nil
+	}
+
 	h := header.BlockHeight
 
-	retargetOffset := h % difficultyRetargetWindow
+	retargetOffset := h % bc.params.RetargetWindow()
 	pastHeaderHeight := h - retargetOffset
 
 	pastHeader := header
 
 	for pastHeader.BlockHeight > pastHeaderHeight {
 		// Skip along the main chain if possible
-		if mainID, ok := bc.heightToHash[pastHeader.BlockHeight]; ok {
-			if pastHeader.Header.Sum() == mainID {
-				pastHeaderID := bc.heightToHash[pastHeaderHeight]
-				pastHeader, err = bc.getHeader(pastHeaderID)
-				if err != nil {
-					return 0, err
-				}
-				break
+		if pastHeader.IsMainChain {
+			pastHeaderID, err := bc.getHeightHash(pastHeaderHeight)
+			if err != nil {
+				return 0, err
 			}
+			pastHeader, err = bc.getHeader(pastHeaderID)
+			if err != nil {
+				return 0, err
+			}
+			break
 		}
 
 		pastHeader, err = bc.getHeader(pastHeader.Header.ParentID)
@@ -427,10 +449,18 @@ func (bc *blockchain) computeDifficulty(id coin.Hash) (uint64, error) {
 		}
 	}
 
-	// TODO: this shouldn't be pastHeader's actual difficulty, but the past target difficulty
-	// We should either store past target difficulty or enforce difficulty == targetDifficulty
-	if h%difficultyRetargetWindow != difficultyRetargetWindow-1 {
-		return pastHeader.Header.Difficulty, nil
+	return nextTargetDifficulty(bc.params, header, pastHeader), nil
+}
+
+// nextTargetDifficulty computes the target difficulty for a child of header,
+// where pastHeader is the first header of header's retarget window.
+func nextTargetDifficulty(params *ChainParams, header, pastHeader *processedHeader) uint64 {
+	window := params.RetargetWindow()
+	targetBlockInterval := int64(params.TargetBlockInterval)
+
+	h := header.BlockHeight
+	if h%window != window-1 {
+		return pastHeader.TargetDifficulty
 	}
 
 	windowTime := header.Header.Timestamp - pastHeader.Header.Timestamp
@@ -439,7 +469,7 @@ func (bc *blockchain) computeDifficulty(id coin.Hash) (uint64, error) {
 	if windowTime <= 0 {
 		ratio = math.Inf(+1)
 	} else {
-		ratio = float64(targetBlockInterval) * float64(difficultyRetargetWindow) / float64(windowTime)
+		ratio = float64(targetBlockInterval) * float64(window) / float64(windowTime)
 	}
 	logRatio := math.Log2(ratio)
 
@@ -447,26 +477,102 @@ func (bc *blockchain) computeDifficulty(id coin.Hash) (uint64, error) {
 		ratio, windowTime, targetBlockInterval)
 
 	// Clamp to maximum of 4x increase/decrease
-	// TODO: Ditto on past difficulty vs past target difficulty
-	newDifficulty := pastHeader.Header.Difficulty
+	newDifficulty := int64(pastHeader.TargetDifficulty)
 	if logRatio > 2 {
 		newDifficulty += 2
 	} else if logRatio < -2 {
 		newDifficulty -= 2
 	} else if logRatio < 0 {
-		newDifficulty -= uint64(-logRatio)
+		newDifficulty -= int64(-logRatio)
 	} else if logRatio > 0 {
-		newDifficulty += uint64(logRatio)
+		newDifficulty += int64(logRatio)
 	} else {
 		// 0 or NaN, just no-op
 	}
 
-	// Ensure at minimum
-	if newDifficulty < MinimumDifficulty {
-		newDifficulty = MinimumDifficulty
+	return clampDifficulty(params, newDifficulty)
+}
+
+// clampDifficulty ensures d is at least the minimum, and solvable.
+func clampDifficulty(params *ChainParams, d int64) uint64 {
+	if d < int64(params.MinimumDifficulty) {
+		d = int64(params.MinimumDifficulty)
+	} else if d > maxDifficulty {
+		d = maxDifficulty
+	}
+
+	return uint64(d)
+}
+
+// lwmaWindow returns header and up to n of its ancestors, oldest first.
+func lwmaWindow(header *processedHeader, n int,
+	parent func(*processedHeader) (*processedHeader, error)) ([]*processedHeader, error) {
+
+	window := []*processedHeader{header}
+	for len(window) <= n && header.BlockHeight > 0 {
+		var err error
+		if header, err = parent(header); err != nil {
+			return nil, err
+		}
+		window = append(window, header)
+	}
+
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
 	}
+	return window, nil
+}
+
+// lwmaTargetDifficulty computes the target difficulty for a child of the last
+// header in window with a linearly weighted moving average: recent solve
+// times count the most, so the difficulty follows hashpower every block.
+//
+// Averaging happens over work, the expected nonces per solution at each
+// TargetDifficulty, rather than over the difficulty itself: Hamming
+// closeness gets dearer per bit the higher it goes.  Using the target rather
+// than the header's difficulty keeps blocks mined above target from pushing
+// it up.
+func lwmaTargetDifficulty(params *ChainParams, window []*processedHeader) uint64 {
+	n := len(window) - 1
+	if n < 1 {
+		return params.MinimumDifficulty
+	}
+
+	// Clamp solve times so one bad timestamp cannot swing the average
+	T := float64(params.TargetBlockInterval)
+	var weightedTime, work float64
+	for i := 1; i <= n; i++ {
+		st := float64(window[i].Header.Timestamp - window[i-1].Header.Timestamp)
+		st = math.Max(-6*T, math.Min(6*T, st))
+		weightedTime += float64(i) * st
+		work += miner.Work(window[i].TargetDifficulty)
+	}
+
+	k := float64(n*(n+1)) / 2
+	weightedTime = math.Max(weightedTime, k*T/10)
+
+	return workDifficulty(params, work/float64(n)*k*T/weightedTime, window[n].TargetDifficulty)
+}
 
-	return newDifficulty, nil
+// workDifficulty returns the difficulty whose work is nearest to work by
+// ratio.  Low difficulties cost about the same, so ties go to the one
+// nearest prev.
+func workDifficulty(params *ChainParams, work float64, prev uint64) uint64 {
+	distance := func(d uint64) uint64 {
+		if d > prev {
+			return d - prev
+		}
+		return prev - d
+	}
+
+	best, bestErr := params.MinimumDifficulty, math.Inf(+1)
+	for d := params.MinimumDifficulty; d <= maxDifficulty; d++ {
+		e := math.Abs(math.Log2(miner.Work(d) / work))
+		if e < bestErr || e == bestErr && distance(d) < distance(best) {
+			best, bestErr = d, e
+		}
+	}
+	return best
 }
 
 /*
@@ -474,12 +580,13 @@ func (bc *blockchain) computeDifficulty(id coin.Hash) (uint64, error) {
  */
 
 func (bc *blockchain) processHeader(h coin.Header) (*processedHeader, error) {
-	if len(bc.heightToHash) == 0 {
+	if bc.empty() {
 		// Process genesis header
 		return &processedHeader{
-			Header:          h,
-			BlockHeight:     0,
-			TotalDifficulty: h.Difficulty,
+			Header:           h,
+			BlockHeight:      0,
+			TotalDifficulty:  h.Difficulty,
+			TargetDifficulty: bc.params.MinimumDifficulty,
 		}, nil
 	} else {
 		// Check that block extends existing header
@@ -497,44 +604,80 @@ func (bc *blockchain) processHeader(h coin.Header) (*processedHeader, error) {
 			return nil, ErrDifficulty
 		}
 
+		mtp, err := bc.medianTimePast(prevHeader)
+		if err != nil {
+			return nil, err
+		}
+		if h.Timestamp <= mtp {
+			return nil, ErrMedianTime
+		}
+
 		return &processedHeader{
-			Header:          h,
-			BlockHeight:     prevHeader.BlockHeight + 1,
-			TotalDifficulty: prevHeader.TotalDifficulty + h.Difficulty,
+			Header:           h,
+			BlockHeight:      prevHeader.BlockHeight + 1,
+			TotalDifficulty:  prevHeader.TotalDifficulty + h.Difficulty,
+			TargetDifficulty: targetDiff,
 		}, nil
 	}
 }
 
+// medianTimePast returns the median timestamp of ph and its ancestors, up to
+// MedianTimeSpan headers in all.  It follows parent links rather than the
+// height index, so it holds on side chains too.
+func (bc *blockchain) medianTimePast(ph *processedHeader) (int64, error) {
+	n := bc.params.MedianTimeSpan
+	if n == 0 {
+		return math.MinInt64, nil
+	}
+
+	times := make([]int64, 0, n)
+	for {
+		times = append(times, ph.Header.Timestamp)
+		if len(times) == n || ph.BlockHeight == 0 {
+			break
+		}
+		var err error
+		if ph, err = bc.getHeader(ph.Header.ParentID); err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2], nil
+}
+
 /*
  * Header/Block Database Wrappers (GET/PUT)
  */
 
 func (bc *blockchain) getHeader(h coin.Hash) (*processedHeader, error) {
 	id := bucket(HeaderBucket, h)
-	headerBytes, err := bc.db.Get(id, nil)
+	headerBytes, err := bc.store.Get(id)
 	if err != nil {
 		return nil, err
 	}
 
-	var pheader *processedHeader
-	err = json.Unmarshal(headerBytes, &pheader)
+	pheader := new(processedHeader)
+	if err := pheader.UnmarshalBinary(headerBytes); err != nil {
+		return nil, err
+	}
 
-	return pheader, err
+	return pheader, nil
 }
 
 func (bc *blockchain) putHeader(ph processedHeader) error {
-	headerJson, err := json.Marshal(ph)
+	headerBytes, err := ph.MarshalBinary()
 	if err != nil {
 		return err
 	}
 	id := bucket(HeaderBucket, ph.Header.Sum())
 
-	return bc.db.Put(id, headerJson, nil)
+	return bc.store.Put(id, headerBytes)
 }
 
 func (bc *blockchain) getBlock(h coin.Hash) (string, error) {
 	id := bucket(BlockBucket, h)
-	blockBytes, err := bc.db.Get(id, nil)
+	blockBytes, err := bc.store.Get(id)
 	if err != nil {
 		return "", err
 	}
@@ -544,7 +687,21 @@ func (bc *blockchain) getBlock(h coin.Hash) (string, error) {
 
 func (bc *blockchain) putBlock(h coin.Hash, b coin.Block) error {
 	id := bucket(BlockBucket, h)
-	return bc.db.Put(id, []byte(b), nil)
+	return bc.store.Put(id, []byte(b))
+}
+
+func (bc *blockchain) getHeightHash(height uint64) (coin.Hash, error) {
+	var id coin.Hash
+	b, err := bc.store.Get(heightKey(height))
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("malformed height index entry at %d", height)
+	}
+	copy(id[:], b)
+
+	return id, nil
 }
 
 /*
@@ -554,3 +711,10 @@ func (bc *blockchain) putBlock(h coin.Hash, b coin.Block) error {
 func bucket(b string, h coin.Hash) []byte {
 	return append([]byte(b), h[:]...)
 }
+
+func heightKey(height uint64) []byte {
+	b := make([]byte, len(HeightBucket)+8)
+	copy(b, HeightBucket)
+	binary.BigEndian.PutUint64(b[len(HeightBucket):], height)
+	return b
+}
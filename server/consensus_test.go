@@ -0,0 +1,368 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"../coin"
+	"../coin/miner"
+)
+
+var testGenesisTime = time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// testChain is a regtest chain in memory, driven by a simulated clock.
+type testChain struct {
+	t     *testing.T
+	bc    *blockchain
+	clock *SimClock
+}
+
+func newTestChain(t *testing.T) *testChain {
+	params, err := LoadChainParams("", "regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := MineGenesis(params, testGenesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewSimClock(testGenesisTime)
+	bc, err := newBlockchain(NewMemoryStore(), params, genesis, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testChain{t, bc, clock}
+}
+
+// second is n seconds after the genesis block.
+func second(n int) time.Time {
+	return testGenesisTime.Add(time.Duration(n) * time.Second)
+}
+
+func (c *testChain) genesis() coin.Hash {
+	id, err := c.bc.getHeightHash(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return id
+}
+
+// add mines a block by team on parent at its target difficulty and
+// timestamp ts, and submits it with the clock set to ts.
+func (c *testChain) add(parent coin.Hash, ts time.Time, team string) (coin.Hash, error) {
+	c.bc.Lock()
+	difficulty, err := c.bc.computeDifficulty(parent)
+	c.bc.Unlock()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	h, b := c.mine(parent, difficulty, ts, team)
+	c.clock.Set(ts)
+	return h.Sum(), c.bc.AddBlock(h, b)
+}
+
+func (c *testChain) mine(parent coin.Hash, difficulty uint64, ts time.Time,
+	team string) (coin.Header, coin.Block) {
+
+	h := coin.Header{ParentID: parent, Difficulty: difficulty, Timestamp: ts.UnixNano()}
+	b := coin.Block(team)
+	if err := h.MineBlock(b); err != nil {
+		c.t.Fatal(err)
+	}
+	return h, b
+}
+
+// extend adds n blocks on parent, spaced interval apart after start, and
+// returns the last one.
+func (c *testChain) extend(parent coin.Hash, start time.Time, n int,
+	interval time.Duration, team string) (coin.Hash, time.Time) {
+
+	ts := start
+	for i := 0; i < n; i++ {
+		ts = ts.Add(interval)
+		var err error
+		if parent, err = c.add(parent, ts, team); err != nil {
+			c.t.Fatalf("block %d of %d: %v", i+1, n, err)
+		}
+	}
+	return parent, ts
+}
+
+func TestRetarget(t *testing.T) {
+	target := time.Duration(newTestChain(t).bc.params.TargetBlockInterval)
+
+	tests := []struct {
+		name      string
+		intervals []time.Duration // block spacing in each retarget window
+		want      uint64
+	}{
+		{"on target", []time.Duration{target}, 1},
+		{"2.5x fast", []time.Duration{target * 2 / 5}, 2},
+		{"10x fast clamps to +2", []time.Duration{target / 10}, 3},
+		{"two fast windows", []time.Duration{target / 10, target / 10}, 5},
+		{"2.5x slow", []time.Duration{target / 10, target * 5 / 2}, 2},
+		{"10x slow clamps to -2", []time.Duration{target / 10, target / 10, target * 10}, 3},
+		{"slow at minimum", []time.Duration{target * 10}, 1},
+	}
+
+	for _, test := range tests {
+		c := newTestChain(t)
+		window := int(c.bc.params.RetargetWindow())
+
+		id, ts := c.genesis(), testGenesisTime
+		for i, interval := range test.intervals {
+			before := c.bc.currDifficulty
+
+			// The first window starts with the genesis block
+			n := window
+			if i == 0 {
+				n--
+			}
+			id, ts = c.extend(id, ts, n-1, interval, "alice")
+			if c.bc.currDifficulty != before {
+				t.Fatalf("%s: difficulty changed to %d within window %d",
+					test.name, c.bc.currDifficulty, i)
+			}
+			id, ts = c.extend(id, ts, 1, interval, "alice")
+		}
+
+		if got := c.bc.currDifficulty; got != test.want {
+			t.Errorf("%s: difficulty %d, want %d", test.name, got, test.want)
+		}
+		if c.bc.head.Header.Sum() != id {
+			t.Errorf("%s: last block is not the head", test.name)
+		}
+	}
+}
+
+func TestMedianTimeSideChain(t *testing.T) {
+	c := newTestChain(t)
+	// The main chain's median time is 5s, the side chain's is 101s
+	a2, _ := c.extend(c.genesis(), testGenesisTime, 2, time.Second, "alice")
+	a10, _ := c.extend(a2, second(2), 8, time.Second, "alice")
+	b5, _ := c.extend(a2, second(99), 5, time.Second, "bob")
+
+	if c.bc.head.Header.Sum() != a10 {
+		t.Fatal("side chain became the main chain")
+	}
+	if mtp, _ := c.bc.medianTimePast(&c.bc.head); mtp != second(5).UnixNano() {
+		t.Fatalf("main chain median time %d, want %d", mtp, second(5).UnixNano())
+	}
+
+	for _, ts := range []time.Time{second(50), second(101)} {
+		if _, err := c.add(b5, ts, "bob"); err != ErrMedianTime {
+			t.Errorf("side block at %s: got %v, want %v", ts, err, ErrMedianTime)
+		}
+	}
+	if _, err := c.add(b5, second(101).Add(time.Nanosecond), "bob"); err != nil {
+		t.Errorf("side block after its median time: %v", err)
+	}
+}
+
+func TestMedianTimeSideChainBehindMain(t *testing.T) {
+	c := newTestChain(t)
+	// The main chain's median time is 104s, the side chain's is 2s
+	a10, _ := c.extend(c.genesis(), second(99), 10, time.Second, "alice")
+	b3, _ := c.extend(c.genesis(), testGenesisTime, 3, time.Second, "bob")
+
+	if c.bc.head.Header.Sum() != a10 {
+		t.Fatal("side chain became the main chain")
+	}
+	if mtp, _ := c.bc.medianTimePast(&c.bc.head); mtp != second(104).UnixNano() {
+		t.Fatalf("main chain median time %d, want %d", mtp, second(104).UnixNano())
+	}
+
+	if _, err := c.add(b3, second(2), "bob"); err != ErrMedianTime {
+		t.Errorf("side block at its median time: got %v, want %v", err, ErrMedianTime)
+	}
+	if _, err := c.add(b3, second(50), "bob"); err != nil {
+		t.Errorf("side block after its own median time but before the main chain's: %v", err)
+	}
+}
+
+func TestMedianTimeAfterReorg(t *testing.T) {
+	c := newTestChain(t)
+	// The side chain takes over with a median time of 102s, while the old
+	// main chain's stays at 2s
+	a3, _ := c.extend(c.genesis(), testGenesisTime, 3, time.Second, "alice")
+	b5, _ := c.extend(c.genesis(), second(99), 5, time.Second, "bob")
+
+	if c.bc.head.Header.Sum() != b5 {
+		t.Fatal("side chain did not become the main chain")
+	}
+	if mtp, _ := c.bc.medianTimePast(&c.bc.head); mtp != second(102).UnixNano() {
+		t.Fatalf("main chain median time %d, want %d", mtp, second(102).UnixNano())
+	}
+
+	for _, ts := range []time.Time{second(50), second(102)} {
+		if _, err := c.add(b5, ts, "bob"); err != ErrMedianTime {
+			t.Errorf("main block at %s: got %v, want %v", ts, err, ErrMedianTime)
+		}
+	}
+	if _, err := c.add(b5, second(102).Add(time.Nanosecond), "bob"); err != nil {
+		t.Errorf("main block after its median time: %v", err)
+	}
+	if _, err := c.add(a3, second(50), "alice"); err != nil {
+		t.Errorf("block on the old main chain after its own median time: %v", err)
+	}
+}
+
+// lwmaTestWindow is n+1 headers with solve times of interval, each mined at
+// difficulty above its target.
+func lwmaTestWindow(n int, interval time.Duration, target, difficulty uint64) []*processedHeader {
+	window := make([]*processedHeader, n+1)
+	for i := range window {
+		window[i] = &processedHeader{
+			Header: coin.Header{
+				Difficulty: difficulty,
+				Timestamp:  testGenesisTime.Add(time.Duration(i) * interval).UnixNano(),
+			},
+			BlockHeight:      uint64(i),
+			TargetDifficulty: target,
+		}
+	}
+	return window
+}
+
+func TestLWMAUsesTargetDifficulty(t *testing.T) {
+	params, err := LoadChainParams("", "regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	T := time.Duration(params.TargetBlockInterval)
+
+	// On target, so the next target is unchanged however far the blocks
+	// were mined above it
+	if got := lwmaTargetDifficulty(params, lwmaTestWindow(10, T, 90, 110)); got != 90 {
+		t.Errorf("lwmaTargetDifficulty = %d, want 90", got)
+	}
+
+	// Difficulties up to here all cost the same work, so it stays put
+	if got := lwmaTargetDifficulty(params, lwmaTestWindow(10, T, 20, 20)); got != 20 {
+		t.Errorf("lwmaTargetDifficulty at negligible work = %d, want 20", got)
+	}
+}
+
+func TestLWMAFollowsWork(t *testing.T) {
+	params, err := LoadChainParams("", "regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	T := time.Duration(params.TargetBlockInterval)
+
+	// Blocks twice as fast as target call for about twice the work, which
+	// is a few bits of closeness at 70 but less than one at 120
+	want := map[uint64]uint64{70: 73, 80: 82, 120: 120}
+	for target, next := range want {
+		got := lwmaTargetDifficulty(params, lwmaTestWindow(10, T/2, target, target))
+		if got != next {
+			t.Errorf("target %d at 2x hashpower: next %d, want %d", target, got, next)
+		}
+	}
+
+	// Solve times are clamped to a tenth of the target
+	for _, target := range []uint64{80, 100, 120} {
+		got := lwmaTargetDifficulty(params, lwmaTestWindow(10, T/100, target, target))
+		if r := miner.Work(got) / miner.Work(target); r < 10/math.Sqrt(20) || r > 10*math.Sqrt(20) {
+			t.Errorf("target %d at 100x hashpower: next %d, %g times the work", target, got, r)
+		}
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	c := newTestChain(t)
+	difficulty := c.bc.params.MinimumDifficulty
+	c.clock.Set(second(2))
+
+	parent, parentBlock := c.mine(c.genesis(), difficulty, second(1), "alice")
+	child, childBlock := c.mine(parent.Sum(), difficulty, second(2), "alice")
+
+	if err := c.bc.AddBlock(child, childBlock); err != ErrOrphan {
+		t.Fatalf("child before parent: got %v, want %v", err, ErrOrphan)
+	}
+	if status, rej := newRejection(ErrOrphan); status != http.StatusAccepted || rej.Code != RejectOrphaned {
+		t.Errorf("orphan answered %d %s, want %d %s", status, rej.Code,
+			http.StatusAccepted, RejectOrphaned)
+	}
+
+	// A pooled orphan is a duplicate, but not spam: once dropped from the
+	// pool it must be accepted again
+	if err := c.bc.AddBlock(child, childBlock); err != ErrSpamHeader {
+		t.Fatalf("resent orphan: got %v, want %v", err, ErrSpamHeader)
+	}
+	if err := c.bc.spam.check(child.Sum(), c.clock.Now()); err != nil {
+		t.Fatalf("resent orphan was added to the spam filter: %v", err)
+	}
+	c.bc.orphans.take(parent.Sum())
+	if err := c.bc.AddBlock(child, childBlock); err != ErrOrphan {
+		t.Fatalf("orphan resent after leaving the pool: got %v, want %v", err, ErrOrphan)
+	}
+
+	// The parent connects the orphan
+	if err := c.bc.AddBlock(parent, parentBlock); err != nil {
+		t.Fatal(err)
+	}
+	if c.bc.head.Header.Sum() != child.Sum() {
+		t.Fatal("orphan was not connected to its parent")
+	}
+	if c.bc.orphans.has(child.Sum()) {
+		t.Error("connected orphan is still pooled")
+	}
+
+	// Stored blocks are remembered as spam
+	if err := c.bc.AddBlock(child, childBlock); err != ErrSpamHeader {
+		t.Fatalf("resent block: got %v, want %v", err, ErrSpamHeader)
+	}
+	if err := c.bc.spam.check(child.Sum(), c.clock.Now()); err != ErrSpamHeader {
+		t.Errorf("resent block is not in the spam filter: %v", err)
+	}
+}
+
+func TestOrphanSiblings(t *testing.T) {
+	c := newTestChain(t)
+	genesisName, err := c.bc.getBlock(c.genesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	difficulty := c.bc.params.MinimumDifficulty
+	c.clock.Set(second(3))
+
+	parent, parentBlock := c.mine(c.genesis(), difficulty, second(1), "alice")
+	var children []coin.Hash
+	for _, team := range []string{"bob", "carol", "dave"} {
+		h, b := c.mine(parent.Sum(), difficulty, second(2), team)
+		if err := c.bc.AddBlock(h, b); err != ErrOrphan {
+			t.Fatalf("%s's child before parent: got %v, want %v", team, err, ErrOrphan)
+		}
+		children = append(children, h.Sum())
+	}
+	grandchild, grandchildBlock := c.mine(children[1], difficulty, second(3), "erin")
+	if err := c.bc.AddBlock(grandchild, grandchildBlock); err != ErrOrphan {
+		t.Fatalf("grandchild before parent: got %v, want %v", err, ErrOrphan)
+	}
+
+	if err := c.bc.AddBlock(parent, parentBlock); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range append(children, grandchild.Sum()) {
+		if _, err := c.bc.getHeader(id); err != nil {
+			t.Errorf("orphan %d was not connected: %v", i, err)
+		}
+		if c.bc.orphans.has(id) {
+			t.Errorf("connected orphan %d is still pooled", i)
+		}
+	}
+	if n := len(c.bc.orphans.list(c.clock.Now())); n != 0 {
+		t.Errorf("%d orphans left in the pool", n)
+	}
+	if c.bc.head.Header.Sum() != grandchild.Sum() {
+		t.Error("longest branch of orphans is not the head")
+	}
+	checkScores(t, c.bc, map[string]int{scoreRawPrefix + genesisName: 1,
+		"members:alice": 1, "members:bob": 1, "members:carol": 1,
+		"members:dave": 1, "members:erin": 1})
+}
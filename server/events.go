@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"../coin"
+)
+
+// Event types sent on /events
+const (
+	EventBlock     = "block"     // new main chain block
+	EventSideBlock = "sideblock" // new side chain block
+	EventReorg     = "reorg"     // main chain switched branches
+	EventRetarget  = "retarget"  // difficulty of the next block changed
+	EventScore     = "score"     // a team's score changed
+)
+
+const (
+	// Events kept for clients resuming with Last-Event-ID
+	MaxEventHistory = 1000
+
+	// Events a slow client may fall behind by before it is dropped, to
+	// reconnect and resume
+	eventBuffer = 64
+
+	eventKeepAlive = 15 * time.Second
+)
+
+type (
+	// Event is a chain event.  IDs are "<epoch>-<seq>": seq counts up within
+	// one run of the server, identified by epoch.
+	Event struct {
+		ID   string      `json:"id"`
+		Type string      `json:"type"`
+		Time time.Time   `json:"time"`
+		Data interface{} `json:"data"`
+	}
+
+	blockEvent struct {
+		ID          coin.Hash `json:"id"`
+		Height      uint64    `json:"height"`
+		TotalDiff   uint64    `json:"totaldiff"`
+		Team        string    `json:"team"`
+		IsMainChain bool      `json:"ismainchain"`
+	}
+
+	reorgEvent struct {
+		OldHead coin.Hash `json:"oldhead"`
+		NewHead coin.Hash `json:"newhead"`
+		Depth   int       `json:"depth"`
+	}
+
+	retargetEvent struct {
+		Height        uint64 `json:"height"`
+		OldDifficulty uint64 `json:"olddifficulty"`
+		NewDifficulty uint64 `json:"newdifficulty"`
+	}
+
+	scoreEvent struct {
+		Team  string `json:"team"`
+		Total int    `json:"total"`
+		Main  int    `json:"mainchain"`
+		Ever  int    `json:"everinmainchain"`
+	}
+
+	// eventHub fans events out to subscribers and keeps a bounded history.
+	// Publishing never blocks.
+	eventHub struct {
+		sync.Mutex
+		epoch   int64
+		seq     uint64
+		history []Event
+		subs    map[chan Event]struct{}
+	}
+)
+
+func newEventHub(now time.Time) *eventHub {
+	return &eventHub{
+		epoch: now.Unix(),
+		subs:  make(map[chan Event]struct{}),
+	}
+}
+
+func (eh *eventHub) publish(typ string, data interface{}, now time.Time) {
+	eh.Lock()
+	defer eh.Unlock()
+
+	eh.seq++
+	e := Event{
+		ID:   fmt.Sprintf("%d-%d", eh.epoch, eh.seq),
+		Type: typ,
+		Time: now,
+		Data: data,
+	}
+
+	eh.history = append(eh.history, e)
+	if len(eh.history) > MaxEventHistory {
+		eh.history = eh.history[len(eh.history)-MaxEventHistory:]
+	}
+
+	for ch := range eh.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(eh.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of new events, along with the events after
+// lastID if it is still in history.  Without a lastID, or with one that has
+// left history or is from another epoch, there is no backlog: new clients
+// start from the current event.
+func (eh *eventHub) subscribe(lastID string) (chan Event, []Event) {
+	eh.Lock()
+	defer eh.Unlock()
+
+	var backlog []Event
+	for i, e := range eh.history {
+		if lastID != "" && e.ID == lastID {
+			backlog = append(backlog, eh.history[i+1:]...)
+			break
+		}
+	}
+
+	ch := make(chan Event, eventBuffer)
+	eh.subs[ch] = struct{}{}
+	return ch, backlog
+}
+
+func (eh *eventHub) unsubscribe(ch chan Event) {
+	eh.Lock()
+	defer eh.Unlock()
+
+	if _, ok := eh.subs[ch]; ok {
+		delete(eh.subs, ch)
+		close(ch)
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// eventsHandler streams chain events as Server-Sent Events, resuming after
+// the Last-Event-ID header or lastEventId parameter if given.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+
+	ch, backlog := bchain.events.subscribe(lastID)
+	defer bchain.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, e := range backlog {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				// Fell too far behind; the client reconnects and resumes
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// publishBlock sends the events for a block just added by extendChain.
+func (bc *blockchain) publishBlock(ph *processedHeader, team string, oldHead processedHeader,
+	reverted int, oldDifficulty uint64, changes scoreChanges) {
+
+	now := bc.clock.Now()
+	id := ph.Header.Sum()
+
+	if reverted > 0 {
+		bc.events.publish(EventReorg, reorgEvent{
+			OldHead: oldHead.Header.Sum(),
+			NewHead: id,
+			Depth:   reverted,
+		}, now)
+	}
+
+	typ := EventSideBlock
+	if ph.IsMainChain {
+		typ = EventBlock
+	}
+	bc.events.publish(typ, blockEvent{
+		ID:          id,
+		Height:      ph.BlockHeight,
+		TotalDiff:   ph.TotalDifficulty,
+		Team:        team,
+		IsMainChain: ph.IsMainChain,
+	}, now)
+
+	if bc.currDifficulty != oldDifficulty {
+		bc.events.publish(EventRetarget, retargetEvent{
+			Height:        ph.BlockHeight + 1,
+			OldDifficulty: oldDifficulty,
+			NewDifficulty: bc.currDifficulty,
+		}, now)
+	}
+
+	teams := make(map[string]bool)
+	for k := range changes {
+		teams[k.team] = true
+	}
+	sorted := make([]string, 0, len(teams))
+	for t := range teams {
+		sorted = append(sorted, t)
+	}
+	sort.Strings(sorted)
+	for _, t := range sorted {
+		bc.events.publish(EventScore, scoreEvent{
+			Team:  t,
+			Total: bc.scores[t],
+			Main:  bc.mainscores[t],
+			Ever:  bc.everscores[t],
+		}, now)
+	}
+}
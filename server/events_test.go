@@ -0,0 +1,39 @@
+package server
+
+import "testing"
+
+func TestEventReplay(t *testing.T) {
+	eh := newEventHub(testGenesisTime)
+	for i := 0; i < 3; i++ {
+		eh.publish(EventBlock, i, testGenesisTime)
+	}
+	first := eh.history[0].ID
+
+	tests := []struct {
+		lastID string
+		want   int
+	}{
+		{"", 0},
+		{first, 2},
+		{eh.history[2].ID, 0},
+		{"0-1", 0},
+		{"not an id", 0},
+	}
+	for _, test := range tests {
+		ch, backlog := eh.subscribe(test.lastID)
+		eh.unsubscribe(ch)
+		if len(backlog) != test.want {
+			t.Errorf("subscribe(%q) replayed %d events, want %d", test.lastID, len(backlog), test.want)
+		}
+	}
+
+	// Once an event leaves history, resuming from it replays nothing
+	for i := 0; i < MaxEventHistory; i++ {
+		eh.publish(EventBlock, i, testGenesisTime)
+	}
+	ch, backlog := eh.subscribe(first)
+	eh.unsubscribe(ch)
+	if len(backlog) != 0 {
+		t.Errorf("resuming from a forgotten event replayed %d events", len(backlog))
+	}
+}
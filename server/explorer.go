@@ -10,8 +10,6 @@ import (
 	"net/http"
 	"sync"
 	"time"
-
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // TODO currently updates every minute, but could update every new block
@@ -76,12 +74,13 @@ func (e *explorer) executeTemplate() ([]byte, error) {
 	bchain.Lock()
 	headId := bchain.head.Header.Sum()
 	totalHeight := bchain.head.BlockHeight
-	iter := bchain.db.NewIterator(util.BytesPrefix([]byte(HeaderBucket)), nil)
+	iter := bchain.store.NewIterator([]byte(HeaderBucket))
+	defer iter.Release()
 	for iter.Next() {
 		// Load header
 		headerBytes := iter.Value()
 		var pheader processedHeader
-		if err := json.Unmarshal(headerBytes, &pheader); err != nil {
+		if err := pheader.UnmarshalBinary(headerBytes); err != nil {
 			bchain.Unlock()
 			return nil, err
 		}
@@ -93,16 +92,22 @@ func (e *explorer) executeTemplate() ([]byte, error) {
 		parentID := pheader.Header.ParentID
 
 		hash := pheader.Header.Sum()
-		label, err := bchain.getBlock(hash)
+		block, err := bchain.getBlock(hash)
 		if err != nil {
 			bchain.Unlock()
 			return nil, err
 		}
-		trunc := 5
-		if len(label) < trunc {
-			trunc = len(label)
+		label := []rune(scoreLabel(bchain.scoreName(&pheader.Header, block)))
+		if len(label) > 5 {
+			label = label[:5]
+		}
+
+		// JSON escapes quotes and <, so the label stays inside its string
+		labelJS, err := json.Marshal(string(label))
+		if err != nil {
+			bchain.Unlock()
+			return nil, err
 		}
-		label = label[:trunc]
 
 		var color string
 		if pheader.IsMainChain {
@@ -113,11 +118,15 @@ func (e *explorer) executeTemplate() ([]byte, error) {
 			color = "black"
 		}
 
-		fmt.Fprintf(nodes, "{id:'%x',level:%d,label:'%s',color:'%s'},\n",
-			hash[:], pheader.BlockHeight, label, color)
+		fmt.Fprintf(nodes, "{id:'%x',level:%d,label:%s,color:'%s'},\n",
+			hash[:], pheader.BlockHeight, labelJS, color)
 		fmt.Fprintf(edges, "{from:'%s',to:'%x',color:'%s'},\n",
 			parentID, hash[:], color)
 	}
+	if err := iter.Error(); err != nil {
+		bchain.Unlock()
+		return nil, err
+	}
 	bchain.Unlock()
 
 	data := &explorerTemplateData{
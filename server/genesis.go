@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"../coin"
+	"../coin/miner"
+)
+
+// Every genesis block carries this message and the chain params digest
+const genesisMessage = "Never roll your own crypto"
+
+// GenesisDir holds the checked in genesis block of each network, as
+// genesis/<network>.json.
+var GenesisDir = "genesis"
+
+func genesisBlock(params *ChainParams) coin.Block {
+	digest := params.Digest()
+	return coin.Block(fmt.Sprintf("%s (%s %x)", genesisMessage, params.Name, digest[:8]))
+}
+
+// LoadGenesis reads and verifies the genesis block of params' network.
+func LoadGenesis(params *ChainParams) (*compositeBlock, error) {
+	path := filepath.Join(GenesisDir, params.Name+".json")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis := new(compositeBlock)
+	if err := json.Unmarshal(b, genesis); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := verifyGenesis(params, genesis); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return genesis, nil
+}
+
+func verifyGenesis(params *ChainParams, genesis *compositeBlock) error {
+	h := &genesis.Header
+	switch {
+	case genesis.Block != genesisBlock(params):
+		return ErrChainParams
+	case h.ParentID != coin.Hash{}:
+		return fmt.Errorf("genesis block has a parent")
+	case h.Difficulty < params.MinimumDifficulty:
+		return ErrDifficulty
+	}
+
+	return h.ValidLimit(genesis.Block, params.MaxBlockSize, nil)
+}
+
+// MineGenesis mines a new genesis block for params at timestamp t.
+func MineGenesis(params *ChainParams, t time.Time) (*compositeBlock, error) {
+	b := genesisBlock(params)
+
+	h := coin.Header{
+		Difficulty: params.MinimumDifficulty,
+		Timestamp:  t.UnixNano(),
+	}
+	if err := h.SetMerkleRoot(b); err != nil {
+		return nil, err
+	}
+
+	h, err := miner.Mine(context.Background(), h, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compositeBlock{Header: h, Block: b}, nil
+}
+
+// WriteGenesis mines a new genesis block for params at timestamp t and
+// writes it to w in the format read by LoadGenesis.
+func WriteGenesis(w io.Writer, params *ChainParams, t time.Time) error {
+	genesis, err := MineGenesis(params, t)
+	if err != nil {
+		return err
+	}
+
+	j, err := json.MarshalIndent(genesis, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(j, '\n'))
+	return err
+}
+
+// addGenesis adds the genesis block to an empty chain.  It skips the clock
+// drift check, as the genesis timestamp is fixed.
+func (bc *blockchain) addGenesis(genesis *compositeBlock) error {
+	bc.Lock()
+	defer bc.Unlock()
+
+	ph, err := bc.processHeader(genesis.Header)
+	if err != nil {
+		return err
+	}
+
+	return bc.extendChain(ph, genesis.Block)
+}
+
+// checkGenesis ensures the database starts with genesis.  Databases from
+// before chain params have a mined genesis block that only carries the
+// message, and are accepted as mainnet.
+func (bc *blockchain) checkGenesis(genesis *compositeBlock) error {
+	id, err := bc.getHeightHash(0)
+	if err != nil {
+		return err
+	}
+	if id == genesis.Header.Sum() {
+		return nil
+	}
+
+	b, err := bc.getBlock(id)
+	if err != nil {
+		return err
+	}
+	mainnet := profiles[DefaultNetwork]
+	if b == genesisMessage && bc.params.Digest() == mainnet.Digest() {
+		return nil
+	}
+	if coin.Block(b) != genesisBlock(bc.params) {
+		return ErrChainParams
+	}
+
+	return ErrGenesis
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadGenesis(t *testing.T) {
+	defer func(dir string) { GenesisDir = dir }(GenesisDir)
+	GenesisDir = filepath.Join("..", "genesis")
+
+	for network := range profiles {
+		params, err := LoadChainParams("", network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadGenesis(params); err != nil {
+			t.Errorf("%s: %v", network, err)
+		}
+	}
+}
@@ -2,35 +2,59 @@ package server
 
 import (
 	"bufio"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
+// AccessLogFlushInterval is how long access log lines may sit in the buffer.
+const AccessLogFlushInterval = time.Second
+
 var (
 	accessLogger    *log.Logger
-	accessLogBuffer *bufio.Writer
+	accessLogBuffer *flushWriter
 
 	bchain *blockchain
 )
 
-func init() {
+func initAccessLog() error {
 	logPath := "logs/" + time.Now().Format("2006-01-02_15:04:05")
 	accessFile, err := os.Create(logPath)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return err
 	}
-	accessLogBuffer = bufio.NewWriter(accessFile)
+	accessLogBuffer = &flushWriter{w: bufio.NewWriter(accessFile)}
 	accessLogger = log.New(accessLogBuffer, "", log.LstdFlags)
 
-	// Initialize 857 blockcahin
+	go func() {
+		for range time.Tick(AccessLogFlushInterval) {
+			accessLogBuffer.Flush()
+		}
+	}()
+	return nil
+}
 
-	if bchain, err = newBlockchain(); err != nil {
-		log.Println("[init]", err)
-		panic(err)
-	}
+// flushWriter is a bufio.Writer that can be flushed while log.Logger writes
+// to it.
+type flushWriter struct {
+	sync.Mutex
+	w *bufio.Writer
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.w.Write(p)
+}
+
+func (fw *flushWriter) Flush() error {
+	fw.Lock()
+	defer fw.Unlock()
+	return fw.w.Flush()
 }
 
 func LogHandler(h http.Handler) http.Handler {
@@ -47,10 +71,53 @@ func stripPort(s string) string {
 	return s
 }
 
-func Start(addr string) error {
+// Options configure the HTTP server.
+type Options struct {
+	RateLimits map[string]RateLimit
+
+	// Bearer token for the /admin/ endpoints, which are disabled without one
+	AdminToken string
+}
+
+// LoadOptions reads the server options from the config file at path, which
+// may be empty.
+func LoadOptions(path string) (*Options, error) {
+	config, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := rateLimits(config, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Options{RateLimits: limits, AdminToken: config.AdminToken}, nil
+}
+
+func Start(addr string, params *ChainParams, opts *Options) error {
+	if err := initAccessLog(); err != nil {
+		return err
+	}
+
+	genesis, err := LoadGenesis(params)
+	if err != nil {
+		return fmt.Errorf("unable to load genesis block: %s", err)
+	}
+
+	// Initialize 857 blockcahin
+	store, err := OpenLevelDBStore(BlockchainPath)
+	if err != nil {
+		return fmt.Errorf("unable to open blockchain database: %s", err)
+	}
+	if bchain, err = newBlockchain(store, params, genesis, RealClock{}); err != nil {
+		store.Close()
+		return err
+	}
+
 	server := &http.Server{
 		Addr:        addr,
-		Handler:     LogHandler(http.DefaultServeMux),
+		Handler:     LogHandler(RateLimitHandler(opts.RateLimits, http.DefaultServeMux)),
 		ReadTimeout: 10 * time.Second,
 	}
 
@@ -59,8 +126,12 @@ func Start(addr string) error {
 	http.HandleFunc("/next", nextHandler)
 	http.HandleFunc("/head", headHandler)
 	http.HandleFunc("/scores", scoresHandler)
+	http.HandleFunc("/orphans", orphansHandler)
+	http.HandleFunc("/events", eventsHandler)
+	http.Handle("/admin/teams", adminHandler(opts.AdminToken, http.HandlerFunc(teamsHandler)))
 	http.Handle("/search/", http.StripPrefix("/search/", http.HandlerFunc(searchHandler)))
 	http.Handle("/block/", http.StripPrefix("/block/", http.HandlerFunc(blockHandler)))
+	http.Handle("/proof/", http.StripPrefix("/proof/", http.HandlerFunc(proofHandler)))
 
 	e := NewExplorer()
 	http.HandleFunc("/explore", e.handler)
@@ -68,7 +139,7 @@ func Start(addr string) error {
 	staticHandler := http.FileServer(http.Dir("static"))
 	http.Handle("/static/", http.StripPrefix("/static/", staticHandler))
 
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
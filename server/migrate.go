@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"../coin"
+)
+
+// SchemaVersion is the database layout read and written by this server.
+// Databases created before schema versioning are version 0.
+const SchemaVersion = 5
+
+const SchemaKey = "SCHEMA-VERSION"
+
+// A migration moves the database from schema version-1 to version (up) and
+// back (down).  Each direction only adds writes to batch, which is committed
+// atomically together with the new schema version.
+type migration struct {
+	version int
+	name    string
+	up      func(store ChainStore, params *ChainParams, batch StoreBatch) error
+	down    func(store ChainStore, params *ChainParams, batch StoreBatch) error
+}
+
+var migrations = []migration{
+	{1, "binary header records", upBinaryHeaders, downBinaryHeaders},
+	{2, "height index and head pointer", upHeightIndex, downHeightIndex},
+	{3, "persisted score tables", upScoreTables, downScoreTables},
+	{4, "target difficulty in header records", upTargetDifficulty, downTargetDifficulty},
+	{5, "score tables keyed by team, member list or contents", upCanonicalScores, downCanonicalScores},
+}
+
+// Migrate upgrades or rolls back the LevelDB database at path, created with
+// params, to schema version to.
+func Migrate(path string, params *ChainParams, to int) error {
+	store, err := OpenLevelDBStore(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return migrate(store, params, to)
+}
+
+func migrate(store ChainStore, params *ChainParams, to int) error {
+	if to < 0 || to > SchemaVersion {
+		return fmt.Errorf("unknown schema version %d", to)
+	}
+
+	from, err := getSchemaVersion(store)
+	if err != nil {
+		return err
+	}
+	if from > SchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than %d", from, SchemaVersion)
+	}
+
+	for ; from < to; from++ {
+		m := migrations[from]
+		log.Printf("[Migrate] %d -> %d: %s\n", from, m.version, m.name)
+		if err := applyMigration(store, params, m.up, m.version); err != nil {
+			return fmt.Errorf("migrating to version %d: %s", m.version, err)
+		}
+	}
+
+	for ; from > to; from-- {
+		m := migrations[from-1]
+		log.Printf("[Migrate] %d -> %d: undo %s\n", from, m.version-1, m.name)
+		if err := applyMigration(store, params, m.down, m.version-1); err != nil {
+			return fmt.Errorf("rolling back to version %d: %s", m.version-1, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(store ChainStore, params *ChainParams,
+	step func(ChainStore, *ChainParams, StoreBatch) error, version int) error {
+
+	batch := store.NewBatch()
+	if err := step(store, params, batch); err != nil {
+		return err
+	}
+	putSchemaVersion(batch, version)
+
+	return store.Write(batch)
+}
+
+// checkSchema refuses to open a database with a different schema version,
+// stamping empty databases with the current one.
+func checkSchema(store ChainStore) error {
+	version, err := getSchemaVersion(store)
+	if err != nil {
+		return err
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+
+	if version == 0 {
+		iter := store.NewIterator([]byte(HeaderBucket))
+		empty := !iter.Next()
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+
+		if empty {
+			batch := store.NewBatch()
+			putSchemaVersion(batch, SchemaVersion)
+			return store.Write(batch)
+		}
+	}
+
+	return fmt.Errorf("database schema version is %d, expected %d: run migrate",
+		version, SchemaVersion)
+}
+
+func getSchemaVersion(store ChainStore) (int, error) {
+	b, err := store.Get([]byte(SchemaKey))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("malformed schema version")
+	}
+
+	return int(binary.BigEndian.Uint64(b)), nil
+}
+
+func putSchemaVersion(batch StoreBatch, version int) {
+	if version == 0 {
+		batch.Delete([]byte(SchemaKey))
+		return
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(version))
+	batch.Put([]byte(SchemaKey), b)
+}
+
+/*
+ * Migrations
+ */
+
+// forEachHeader rewrites every header record with rewrite.
+func forEachHeader(store ChainStore, batch StoreBatch,
+	rewrite func(key, value []byte) ([]byte, error)) error {
+
+	iter := store.NewIterator([]byte(HeaderBucket))
+	defer iter.Release()
+	for iter.Next() {
+		value, err := rewrite(iter.Key(), iter.Value())
+		if err != nil {
+			return fmt.Errorf("header %x: %s", iter.Key()[len(HeaderBucket):], err)
+		}
+		batch.Put(append([]byte(nil), iter.Key()...), value)
+	}
+
+	return iter.Error()
+}
+
+func upBinaryHeaders(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	return forEachHeader(store, batch, func(key, value []byte) ([]byte, error) {
+		var ph processedHeader
+		if err := json.Unmarshal(value, &ph); err != nil {
+			return nil, err
+		}
+		return ph.marshalRecord(headerRecordV1)
+	})
+}
+
+func downBinaryHeaders(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	return forEachHeader(store, batch, func(key, value []byte) ([]byte, error) {
+		var ph processedHeader
+		if err := ph.UnmarshalBinary(value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(ph)
+	})
+}
+
+func upHeightIndex(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	var head processedHeader
+
+	iter := store.NewIterator([]byte(HeaderBucket))
+	defer iter.Release()
+	for iter.Next() {
+		var ph processedHeader
+		if err := ph.UnmarshalBinary(iter.Value()); err != nil {
+			return err
+		}
+		if !ph.IsMainChain {
+			continue
+		}
+
+		id := ph.Header.Sum()
+		batch.Put(heightKey(ph.BlockHeight), id[:])
+		if !head.IsMainChain || ph.TotalDifficulty > head.TotalDifficulty {
+			head = ph
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if head.IsMainChain {
+		id := head.Header.Sum()
+		batch.Put([]byte(HeadKey), id[:])
+	}
+
+	return nil
+}
+
+func downHeightIndex(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	iter := store.NewIterator([]byte(HeightBucket))
+	defer iter.Release()
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	batch.Delete([]byte(HeadKey))
+
+	return iter.Error()
+}
+
+// upTargetDifficulty backfills the target difficulty of every header in
+// height order, so each retarget sees the already backfilled targets of its
+// window.
+func upTargetDifficulty(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	headers := make(map[coin.Hash]*processedHeader)
+	var byHeight []*processedHeader
+
+	iter := store.NewIterator([]byte(HeaderBucket))
+	defer iter.Release()
+	for iter.Next() {
+		ph := new(processedHeader)
+		if err := ph.UnmarshalBinary(iter.Value()); err != nil {
+			return err
+		}
+		headers[ph.Header.Sum()] = ph
+		byHeight = append(byHeight, ph)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	sort.Slice(byHeight, func(i, j int) bool {
+		return byHeight[i].BlockHeight < byHeight[j].BlockHeight
+	})
+
+	parent := func(ph *processedHeader) (*processedHeader, error) {
+		p, ok := headers[ph.Header.ParentID]
+		if !ok {
+			return nil, fmt.Errorf("header %s: missing parent", ph.Header.Sum())
+		}
+		return p, nil
+	}
+
+	for _, ph := range byHeight {
+		if ph.BlockHeight == 0 {
+			ph.TargetDifficulty = params.MinimumDifficulty
+		} else {
+			target, err := backfillTarget(params, ph, parent)
+			if err != nil {
+				return err
+			}
+			ph.TargetDifficulty = target
+		}
+
+		b, err := ph.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		batch.Put(bucket(HeaderBucket, ph.Header.Sum()), b)
+	}
+
+	return nil
+}
+
+// backfillTarget recomputes the target difficulty of ph from its ancestors.
+func backfillTarget(params *ChainParams, ph *processedHeader,
+	parent func(*processedHeader) (*processedHeader, error)) (uint64, error) {
+
+	prev, err := parent(ph)
+	if err != nil {
+		return 0, err
+	}
+
+	if params.DifficultyAlgorithm == DifficultyLWMA {
+		window, err := lwmaWindow(prev, params.LWMAWindow, parent)
+		if err != nil {
+			return 0, err
+		}
+		return lwmaTargetDifficulty(params, window), nil
+	}
+
+	pastHeader := prev
+	pastHeaderHeight := prev.BlockHeight - prev.BlockHeight%params.RetargetWindow()
+	for pastHeader.BlockHeight > pastHeaderHeight {
+		if pastHeader, err = parent(pastHeader); err != nil {
+			return 0, err
+		}
+	}
+	return nextTargetDifficulty(params, prev, pastHeader), nil
+}
+
+func downTargetDifficulty(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	return forEachHeader(store, batch, func(key, value []byte) ([]byte, error) {
+		var ph processedHeader
+		if err := ph.UnmarshalBinary(value); err != nil {
+			return nil, err
+		}
+		return ph.marshalRecord(headerRecordV1)
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"../coin"
+)
+
+const (
+	// Most orphans held at once; the oldest is evicted first
+	MaxOrphans = 100
+
+	// Orphans whose parent has not arrived by then are dropped
+	OrphanExpiry = 10 * time.Minute
+)
+
+type (
+	// orphanPool holds valid blocks whose parent is not yet known, keyed by
+	// the missing parent.
+	orphanPool struct {
+		byID     map[coin.Hash]*orphan
+		byParent map[coin.Hash][]*orphan
+	}
+
+	orphan struct {
+		ID     coin.Hash   `json:"id"`
+		Header coin.Header `json:"header"`
+		Block  coin.Block  `json:"block"`
+		Added  time.Time   `json:"added"`
+	}
+)
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		byID:     make(map[coin.Hash]*orphan),
+		byParent: make(map[coin.Hash][]*orphan),
+	}
+}
+
+func (op *orphanPool) has(id coin.Hash) bool {
+	_, ok := op.byID[id]
+	return ok
+}
+
+// add holds a block until its parent arrives, evicting the oldest orphan if
+// the pool is full.
+func (op *orphanPool) add(h coin.Header, b coin.Block, now time.Time) {
+	op.expire(now)
+
+	if len(op.byID) >= MaxOrphans {
+		var oldest *orphan
+		for _, o := range op.byID {
+			if oldest == nil || o.Added.Before(oldest.Added) {
+				oldest = o
+			}
+		}
+		op.remove(oldest)
+	}
+
+	o := &orphan{ID: h.Sum(), Header: h, Block: b, Added: now}
+	op.byID[o.ID] = o
+	op.byParent[h.ParentID] = append(op.byParent[h.ParentID], o)
+}
+
+// take removes and returns the orphans waiting on parent.
+func (op *orphanPool) take(parent coin.Hash) []*orphan {
+	children := op.byParent[parent]
+	delete(op.byParent, parent)
+	for _, o := range children {
+		delete(op.byID, o.ID)
+	}
+	return children
+}
+
+func (op *orphanPool) expire(now time.Time) {
+	for _, o := range op.byID {
+		if now.Sub(o.Added) > OrphanExpiry {
+			op.remove(o)
+		}
+	}
+}
+
+func (op *orphanPool) remove(o *orphan) {
+	delete(op.byID, o.ID)
+
+	siblings := op.byParent[o.Header.ParentID]
+	for i, s := range siblings {
+		if s == o {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(op.byParent, o.Header.ParentID)
+	} else {
+		op.byParent[o.Header.ParentID] = siblings
+	}
+}
+
+// list returns the unexpired orphans, oldest first.
+func (op *orphanPool) list(now time.Time) []*orphan {
+	op.expire(now)
+
+	orphans := make([]*orphan, 0, len(op.byID))
+	for _, o := range op.byID {
+		orphans = append(orphans, o)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Added.Before(orphans[j].Added)
+	})
+	return orphans
+}
+
+// connectOrphans adds every orphan descending from id, now that id is in the
+// chain.  Orphans that turn out to be invalid or already stored are dropped.
+func (bc *blockchain) connectOrphans(id coin.Hash) {
+	bc.orphans.expire(bc.clock.Now())
+
+	queue := []coin.Hash{id}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, o := range bc.orphans.take(parent) {
+			if _, err := bc.getHeader(o.ID); err == nil {
+				continue
+			}
+			ph, err := bc.processHeader(o.Header)
+			if err == nil {
+				err = bc.extendChain(ph, o.Block)
+			}
+			if err != nil {
+				log.Printf("[Orphan] dropping %s: %s\n", o.ID, err)
+				continue
+			}
+			log.Printf("[Orphan] connected %s\n", o.ID)
+			queue = append(queue, o.ID)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"../coin"
+)
+
+// ChainParams are the consensus parameters of a network.  Every node on a
+// network must use identical parameters, so a digest of them is committed to
+// by the genesis block.
+type ChainParams struct {
+	Name                string   `json:"name"`
+	TargetBlockInterval Duration `json:"targetblockinterval"`
+	RetargetLength      Duration `json:"retargetlength"`
+	MaxClockDrift       Duration `json:"maxclockdrift"`
+	MinimumDifficulty   uint64   `json:"minimumdifficulty"`
+	MaxBlockSize        int      `json:"maxblocksize"`
+
+	// A header's timestamp must be after the median timestamp of this many
+	// ancestors, or 0 to disable the rule.
+	MedianTimeSpan int `json:"mediantimespan"`
+
+	// DifficultyWindow (the default) retargets once per RetargetLength;
+	// DifficultyLWMA retargets every block over the last LWMAWindow blocks.
+	//
+	// The algorithm is chosen per network rather than by header version: a
+	// child's target is computed before its header exists, for /next, and
+	// letting the parent's version choose would let any miner switch the
+	// algorithm for everyone after them.
+	DifficultyAlgorithm string `json:"difficultyalgorithm,omitempty"`
+	LWMAWindow          int    `json:"lwmawindow,omitempty"`
+}
+
+const (
+	DifficultyWindow = "window"
+	DifficultyLWMA   = "lwma"
+)
+
+// Built in network profiles
+var profiles = map[string]ChainParams{
+	"mainnet": {
+		Name:                "mainnet",
+		TargetBlockInterval: Duration(10 * time.Minute),
+		RetargetLength:      Duration(24 * time.Hour),
+		MaxClockDrift:       Duration(2 * time.Minute),
+		MinimumDifficulty:   86,
+		MaxBlockSize:        coin.MAX_BLOCK_SIZE,
+		MedianTimeSpan:      11,
+	},
+	"classroom-testnet": {
+		Name:                "classroom-testnet",
+		TargetBlockInterval: Duration(1 * time.Minute),
+		RetargetLength:      Duration(1 * time.Hour),
+		MaxClockDrift:       Duration(2 * time.Minute),
+		MinimumDifficulty:   80,
+		MaxBlockSize:        coin.MAX_BLOCK_SIZE,
+		MedianTimeSpan:      11,
+	},
+	"regtest": {
+		Name:                "regtest",
+		TargetBlockInterval: Duration(1 * time.Second),
+		RetargetLength:      Duration(1 * time.Minute),
+		MaxClockDrift:       Duration(2 * time.Minute),
+		MinimumDifficulty:   1,
+		MaxBlockSize:        coin.MAX_BLOCK_SIZE,
+		MedianTimeSpan:      11,
+	},
+}
+
+const DefaultNetwork = "mainnet"
+
+// Config is the JSON configuration file.  Profiles add networks or override
+// fields of the built in ones, and RateLimits override DefaultRateLimits.
+type Config struct {
+	Network    string                     `json:"network"`
+	Profiles   map[string]json.RawMessage `json:"profiles"`
+	RateLimits map[string]RateLimit       `json:"ratelimits"`
+	AdminToken string                     `json:"admintoken"`
+}
+
+// readConfig reads the config file at path, or returns an empty config if
+// path is empty.
+func readConfig(path string) (Config, error) {
+	var config Config
+	if path == "" {
+		return config, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// LoadChainParams returns the parameters of network, applying any overrides
+// from the config file at path.  Either argument may be empty: network then
+// comes from the config file, falling back to DefaultNetwork.
+func LoadChainParams(path, network string) (*ChainParams, error) {
+	config, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "" {
+		network = config.Network
+	}
+	if network == "" {
+		network = DefaultNetwork
+	}
+
+	params, builtin := profiles[network]
+	override, ok := config.Profiles[network]
+	if !builtin && !ok {
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+	if ok {
+		if err := json.Unmarshal(override, &params); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %s", path, network, err)
+		}
+	}
+	params.Name = network
+
+	if err := params.validate(); err != nil {
+		return nil, fmt.Errorf("network %s: %s", network, err)
+	}
+
+	return &params, nil
+}
+
+func (p *ChainParams) validate() error {
+	switch {
+	case p.TargetBlockInterval <= 0:
+		return fmt.Errorf("target block interval must be positive")
+	case p.RetargetLength < p.TargetBlockInterval:
+		return fmt.Errorf("retarget length is shorter than the target block interval")
+	case p.MaxClockDrift <= 0:
+		return fmt.Errorf("max clock drift must be positive")
+	case p.MinimumDifficulty > 128:
+		return fmt.Errorf("minimum difficulty is above 128")
+	case p.MaxBlockSize <= 0:
+		return fmt.Errorf("max block size must be positive")
+	case p.MedianTimeSpan < 0:
+		return fmt.Errorf("median time span is negative")
+	case p.DifficultyAlgorithm != "" && p.DifficultyAlgorithm != DifficultyWindow &&
+		p.DifficultyAlgorithm != DifficultyLWMA:
+		return fmt.Errorf("unknown difficulty algorithm %q", p.DifficultyAlgorithm)
+	case p.DifficultyAlgorithm == DifficultyLWMA && p.LWMAWindow < 2:
+		return fmt.Errorf("lwma window must be at least 2 blocks")
+	}
+	return nil
+}
+
+// RetargetWindow is the number of blocks between difficulty retargets.
+func (p *ChainParams) RetargetWindow() uint64 {
+	return uint64(p.RetargetLength / p.TargetBlockInterval)
+}
+
+// Digest commits to every parameter.
+func (p *ChainParams) Digest() coin.Hash {
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	return sha256.Sum256(b)
+}
+
+// Duration is a time.Duration written as a string such as "10m0s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"../coin"
+)
+
+// Most members a team may list in a block
+const MaxTeamMembers = 8
+
+var (
+	ErrPayloadUTF8    = errors.New("block is not valid UTF-8")
+	ErrPayloadChars   = errors.New("team members may only use letters, digits, spaces and . - _ ' @")
+	ErrPayloadMembers = errors.New("block must list between 1 and 8 distinct team members")
+)
+
+// canonicalMember folds case and collapses whitespace, so that "Alice  Smith"
+// and "alice smith" are the same member.
+func canonicalMember(m string) (string, error) {
+	m = strings.ToLower(strings.Join(strings.Fields(m), " "))
+	if m == "" {
+		return "", ErrPayloadMembers
+	}
+
+	for _, r := range m {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" .-_'@", r) {
+			return "", ErrPayloadChars
+		}
+	}
+	return m, nil
+}
+
+// canonicalMembers validates a member list and returns it canonicalized and
+// sorted.
+func canonicalMembers(members []string) ([]string, error) {
+	if len(members) == 0 || len(members) > MaxTeamMembers {
+		return nil, ErrPayloadMembers
+	}
+
+	canonical := make([]string, len(members))
+	for i, m := range members {
+		var err error
+		if canonical[i], err = canonicalMember(m); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(canonical)
+	for i := 1; i < len(canonical); i++ {
+		if canonical[i] == canonical[i-1] {
+			return nil, ErrPayloadMembers
+		}
+	}
+	return canonical, nil
+}
+
+// blockMembers validates the member list of a block: the comma separated
+// contents of a version 0 or 1 block, or the entries of a version 2 payload.
+func blockMembers(h *coin.Header, b coin.Block) ([]string, error) {
+	if !utf8.ValidString(string(b)) {
+		return nil, ErrPayloadUTF8
+	}
+
+	if h.Version == 2 {
+		p, err := b.Payload()
+		if err != nil {
+			return nil, err
+		}
+		return canonicalMembers(p.Entries)
+	}
+	return canonicalMembers(b.Entries())
+}
+
+// canonicalTeam validates a block's contents and returns the team it is
+// credited to: the signing team of a version 2 block, and otherwise its
+// canonical member list.
+func canonicalTeam(h *coin.Header, b coin.Block) (string, error) {
+	members, err := blockMembers(h, b)
+	if err != nil {
+		return "", err
+	}
+
+	if h.Version == 2 {
+		p, _ := b.Payload()
+		return p.Team, nil
+	}
+	return strings.Join(members, coin.EntrySeparator), nil
+}
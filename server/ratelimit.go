@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit lets a client make Burst requests at once, refilled at Rate
+// requests per minute.  A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// DefaultRateLimits apply per client to each endpoint.  Patterns ending in
+// "/" cover every path below them, as with http.ServeMux.
+var DefaultRateLimits = map[string]RateLimit{
+	"/add":  {Rate: 4, Burst: 4},
+	"/next": {Rate: 12, Burst: 4},
+	"/head": {Rate: 60, Burst: 10},
+}
+
+// rateLimits returns DefaultRateLimits with the overrides from config.
+func rateLimits(config Config, path string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for pattern, limit := range DefaultRateLimits {
+		limits[pattern] = limit
+	}
+	for pattern, limit := range config.RateLimits {
+		if limit.Rate < 0 || limit.Burst < 0 || (limit.Rate > 0 && limit.Burst == 0) {
+			return nil, fmt.Errorf("%s: rate limit %s: rate and burst must be positive", path, pattern)
+		}
+		limits[pattern] = limit
+	}
+
+	return limits, nil
+}
+
+type (
+	limiter struct {
+		sync.Mutex
+		limit     RateLimit
+		buckets   map[string]*tokenBucket
+		lastSweep time.Time
+	}
+
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+func newLimiter(limit RateLimit) *limiter {
+	return &limiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from client's bucket, or reports how long until one
+// is available.
+func (l *limiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	perToken := time.Duration(float64(time.Minute) / l.limit.Rate)
+	burst := float64(l.limit.Burst)
+
+	// Full buckets are the same as missing ones, so drop them now and then
+	if now.Sub(l.lastSweep) > time.Minute {
+		for c, b := range l.buckets {
+			if b.refill(now, perToken, burst) >= burst {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+
+	if b.refill(now, perToken, burst) < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *tokenBucket) refill(now time.Time, perToken time.Duration, burst float64) float64 {
+	b.tokens = math.Min(burst, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+	return b.tokens
+}
+
+// rateLimitClient identifies a client by its address, narrowed to its team
+// once its API key checks out.  Teams sharing an address get their own
+// buckets, while made up keys do not.
+func rateLimitClient(r *http.Request) string {
+	client := "addr " + stripPort(r.RemoteAddr)
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if team, err := bchain.teamByAPIKey(key); err == nil {
+			client += " team " + team.Name
+		}
+	}
+	return client
+}
+
+// RateLimitHandler rejects requests beyond their endpoint's limit with 429.
+func RateLimitHandler(limits map[string]RateLimit, h http.Handler) http.Handler {
+	limiters := make(map[string]*limiter)
+	for pattern, limit := range limits {
+		if limit.Rate > 0 {
+			limiters[pattern] = newLimiter(limit)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := matchLimiter(limiters, r.URL.Path)
+		if l == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client := rateLimitClient(r)
+		ok, retry := l.allow(client, time.Now())
+		if !ok {
+			secs := int(math.Ceil(retry.Seconds()))
+			accessLogger.Printf("rate limited: %s %s, retry after %ds", client, r.URL.Path, secs)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// matchLimiter finds the limiter of the exact path, or else of the longest
+// matching "/"-terminated pattern.
+func matchLimiter(limiters map[string]*limiter, path string) *limiter {
+	if l, ok := limiters[path]; ok {
+		return l
+	}
+
+	var best string
+	for pattern := range limiters {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return limiters[best]
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 60, Burst: 3})
+	now := testGenesisTime
+
+	tests := []struct {
+		after  time.Duration // since the first request
+		client string
+		ok     bool
+		retry  time.Duration
+	}{
+		// The burst, then one token per second
+		{0, "a", true, 0},
+		{0, "a", true, 0},
+		{0, "a", true, 0},
+		{0, "a", false, time.Second},
+		{500 * time.Millisecond, "a", false, 500 * time.Millisecond},
+		{500 * time.Millisecond, "b", true, 0},
+		{time.Second, "a", true, 0},
+		{time.Second, "a", false, time.Second},
+
+		// Refills stop at the burst
+		{time.Minute, "a", true, 0},
+		{time.Minute, "a", true, 0},
+		{time.Minute, "a", true, 0},
+		{time.Minute, "a", false, time.Second},
+	}
+	for i, test := range tests {
+		ok, retry := l.allow(test.client, now.Add(test.after))
+		if ok != test.ok || retry != test.retry {
+			t.Errorf("request %d by %s after %s: got %t %s, want %t %s", i,
+				test.client, test.after, ok, retry, test.ok, test.retry)
+		}
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 1, Burst: 2})
+	now := testGenesisTime
+
+	l.allow("a", now)
+	l.allow("b", now)
+	l.allow("b", now)
+
+	// A minute on, a has refilled and is forgotten, while b is still short
+	l.allow("c", now.Add(time.Minute+time.Second))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket was not swept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("partly empty bucket was swept")
+	}
+
+	// Not swept again within the minute
+	l.allow("d", now.Add(time.Minute+2*time.Second))
+	if len(l.buckets) != 3 {
+		t.Errorf("%d buckets after the sweep, want 3", len(l.buckets))
+	}
+	if ok, retry := l.allow("b", now.Add(time.Minute+2*time.Second)); !ok || retry != 0 {
+		t.Errorf("b after a minute: got %t %s, want a token", ok, retry)
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	defer func(l *log.Logger) { accessLogger = l }(accessLogger)
+	accessLogger = log.New(ioutil.Discard, "", 0)
+
+	h := RateLimitHandler(map[string]RateLimit{"/add": {Rate: 1, Burst: 1}},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/add", nil))
+		if w.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After %q, want 60", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestMatchLimiter(t *testing.T) {
+	limiters := make(map[string]*limiter)
+	for _, pattern := range []string{"/add", "/block/", "/block/proof/", "/"} {
+		limiters[pattern] = newLimiter(RateLimit{Rate: 1, Burst: 1})
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/add", "/add"},
+		{"/add/more", "/"},
+		{"/block/", "/block/"},
+		{"/block/abc", "/block/"},
+		{"/block/proof/abc", "/block/proof/"},
+		{"/block", "/"},
+		{"/head", "/"},
+	}
+	for _, test := range tests {
+		if l := matchLimiter(limiters, test.path); l != limiters[test.want] {
+			t.Errorf("%s matched the wrong limiter, want %s", test.path, test.want)
+		}
+	}
+
+	delete(limiters, "/")
+	if l := matchLimiter(limiters, "/head"); l != nil {
+		t.Error("/head matched a limiter without a catch all pattern")
+	}
+}
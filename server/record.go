@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"../coin"
+)
+
+// Header records are stored under HEADER-<hash> as
+//
+//	record version (1) | header (coin.HeaderSize) | blockheight (8) |
+//	flags (1) | totaldiff (8) | targetdiff (8, version 2 only)
+//
+// with all integers big-endian.
+const (
+	headerRecordV1     = 1
+	headerRecordV2     = 2
+	headerRecordV1Size = 1 + coin.HeaderSize + 8 + 1 + 8
+	headerRecordV2Size = headerRecordV1Size + 8
+
+	flagMainChain     = 1 << 0
+	flagEverMainChain = 1 << 1
+)
+
+var ErrHeaderRecord = errors.New("malformed header record")
+
+func (ph *processedHeader) MarshalBinary() ([]byte, error) {
+	return ph.marshalRecord(headerRecordV2)
+}
+
+func (ph *processedHeader) marshalRecord(version byte) ([]byte, error) {
+	var b []byte
+	switch version {
+	case headerRecordV1:
+		b = make([]byte, headerRecordV1Size)
+	case headerRecordV2:
+		b = make([]byte, headerRecordV2Size)
+	default:
+		return nil, ErrHeaderRecord
+	}
+	b[0] = version
+
+	hb, err := ph.Header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	offset := 1 + copy(b[1:], hb)
+
+	binary.BigEndian.PutUint64(b[offset:], ph.BlockHeight)
+	offset += 8
+	if ph.IsMainChain {
+		b[offset] |= flagMainChain
+	}
+	if ph.EverMainChain {
+		b[offset] |= flagEverMainChain
+	}
+	offset++
+	binary.BigEndian.PutUint64(b[offset:], ph.TotalDifficulty)
+	offset += 8
+
+	if version >= headerRecordV2 {
+		binary.BigEndian.PutUint64(b[offset:], ph.TargetDifficulty)
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes every record version; version 1 records have no
+// target difficulty.
+func (ph *processedHeader) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return ErrHeaderRecord
+	}
+	switch {
+	case b[0] == headerRecordV1 && len(b) == headerRecordV1Size:
+	case b[0] == headerRecordV2 && len(b) == headerRecordV2Size:
+	default:
+		return ErrHeaderRecord
+	}
+
+	offset := 1 + coin.HeaderSize
+	if err := ph.Header.UnmarshalBinary(b[1:offset]); err != nil {
+		return err
+	}
+
+	ph.BlockHeight = binary.BigEndian.Uint64(b[offset:])
+	offset += 8
+	ph.IsMainChain = b[offset]&flagMainChain != 0
+	ph.EverMainChain = b[offset]&flagEverMainChain != 0
+	offset++
+	ph.TotalDifficulty = binary.BigEndian.Uint64(b[offset:])
+	offset += 8
+
+	ph.TargetDifficulty = 0
+	if b[0] >= headerRecordV2 {
+		ph.TargetDifficulty = binary.BigEndian.Uint64(b[offset:])
+	}
+
+	return nil
+}
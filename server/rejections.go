@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"../coin"
+)
+
+// Stable codes telling miners why /add did not add a block
+const (
+	RejectMalformed      = "malformed"
+	RejectOrphaned       = "orphaned"
+	RejectBadPoW         = "bad_pow"
+	RejectUnknownParent  = "unknown_parent"
+	RejectClockDrift     = "clock_drift"
+	RejectMedianTime     = "median_time"
+	RejectLowDifficulty  = "low_difficulty"
+	RejectDuplicate      = "duplicate"
+	RejectOversize       = "oversize"
+	RejectBadMerkle      = "bad_merkle"
+	RejectUnknownVersion = "unknown_version"
+	RejectBadAPIKey      = "bad_api_key"
+	RejectWrongTeam      = "wrong_team"
+	RejectUnknownTeam    = "unknown_team"
+	RejectBadSignature   = "bad_signature"
+	RejectBadPayload     = "bad_payload"
+	RejectInternal       = "internal_error"
+)
+
+var rejectCodes = map[error]string{
+	coin.ErrInvalidPoW:        RejectBadPoW,
+	coin.ErrBlockSize:         RejectOversize,
+	coin.ErrInvalidMerkleRoot: RejectBadMerkle,
+	coin.ErrUnkownVersion:     RejectUnknownVersion,
+	coin.ErrHeaderEncoding:    RejectMalformed,
+	coin.ErrBlockEncoding:     RejectMalformed,
+	coin.ErrPayloadEncoding:   RejectMalformed,
+	coin.ErrUnknownTeam:       RejectUnknownTeam,
+	coin.ErrInvalidSignature:  RejectBadSignature,
+	ErrPayloadUTF8:            RejectBadPayload,
+	ErrPayloadChars:           RejectBadPayload,
+	ErrPayloadMembers:         RejectBadPayload,
+	ErrOrphan:                 RejectOrphaned,
+	ErrNotFound:               RejectUnknownParent,
+	ErrClockDrift:             RejectClockDrift,
+	ErrMedianTime:             RejectMedianTime,
+	ErrDifficulty:             RejectLowDifficulty,
+	ErrSpamHeader:             RejectDuplicate,
+	ErrAPIKey:                 RejectBadAPIKey,
+	ErrTeamMismatch:           RejectWrongTeam,
+}
+
+// Codes that are not a plain bad request.  An orphaned block is not
+// rejected, only held until its parent arrives.
+var rejectStatus = map[string]int{
+	RejectOrphaned:  http.StatusAccepted,
+	RejectBadAPIKey: http.StatusUnauthorized,
+	RejectWrongTeam: http.StatusForbidden,
+}
+
+// rejection is the JSON body of a failed /add.
+type rejection struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// newRejection maps err to its code.  Errors without one are internal, and
+// their details stay in the log.
+func newRejection(err error) (int, rejection) {
+	if code, ok := rejectCodes[err]; ok {
+		msg := err.Error()
+		if err == ErrNotFound {
+			msg = "parent not found"
+		}
+		status, ok := rejectStatus[code]
+		if !ok {
+			status = http.StatusBadRequest
+		}
+		return status, rejection{code, msg}
+	}
+
+	return http.StatusInternalServerError, rejection{RejectInternal, "internal error"}
+}
+
+func writeRejection(w http.ResponseWriter, status int, rej rejection, err error) {
+	log.Printf("%s: failed to add block: %s: %s", http.StatusText(status), rej.Code, err)
+
+	j, _ := json.MarshalIndent(rej, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+func rejectBlock(w http.ResponseWriter, err error) {
+	status, rej := newRejection(err)
+	writeRejection(w, status, rej, err)
+}
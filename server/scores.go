@@ -0,0 +1,371 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"../coin"
+)
+
+// Per-team counters are stored under SCORE-<kind><teamname> as 8 byte
+// big-endian counts, and written in the same batch as the headers they count.
+const (
+	ScoreBucket = "SCORE-"
+
+	scoreTotal = 'T' // every block
+	scoreMain  = 'M' // blocks currently in the main chain
+	scoreEver  = 'E' // blocks that were ever in the main chain
+)
+
+var scoreKinds = []byte{scoreTotal, scoreMain, scoreEver}
+
+type scoreTables map[byte]map[string]int
+
+func newScoreTables() scoreTables {
+	t := make(scoreTables)
+	for _, kind := range scoreKinds {
+		t[kind] = make(map[string]int)
+	}
+	return t
+}
+
+type scoreKey struct {
+	kind byte
+	team string
+}
+
+// scoreChanges accumulates score updates until their batch is written.
+type scoreChanges map[scoreKey]int
+
+func (c scoreChanges) add(kind byte, team string, n int) {
+	c[scoreKey{kind, team}] += n
+}
+
+func (bc *blockchain) scoreTable(kind byte) map[string]int {
+	switch kind {
+	case scoreTotal:
+		return bc.scores
+	case scoreMain:
+		return bc.mainscores
+	case scoreEver:
+		return bc.everscores
+	}
+	panic(fmt.Sprintf("unknown score kind %q", kind))
+}
+
+// stageScores adds the updated counters to batch.  Memory is only updated by
+// applyScores once the batch has been written.
+func (bc *blockchain) stageScores(c scoreChanges, batch StoreBatch) {
+	for k, n := range c {
+		putScore(batch, k.kind, k.team, bc.scoreTable(k.kind)[k.team]+n)
+	}
+}
+
+func (bc *blockchain) applyScores(c scoreChanges) {
+	for k, n := range c {
+		table := bc.scoreTable(k.kind)
+		table[k.team] += n
+		if table[k.team] == 0 {
+			delete(table, k.team)
+		}
+	}
+}
+
+func (bc *blockchain) loadScores() error {
+	t, err := readScores(bc.store)
+	if err != nil {
+		return err
+	}
+
+	bc.scores = t[scoreTotal]
+	bc.mainscores = t[scoreMain]
+	bc.everscores = t[scoreEver]
+
+	return nil
+}
+
+func scoreDBKey(kind byte, team string) []byte {
+	return []byte(ScoreBucket + string(kind) + team)
+}
+
+func putScore(batch StoreBatch, kind byte, team string, n int) {
+	if n == 0 {
+		batch.Delete(scoreDBKey(kind, team))
+		return
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	batch.Put(scoreDBKey(kind, team), b)
+}
+
+// readScores loads the persisted score tables.
+func readScores(store ChainStore) (scoreTables, error) {
+	t := newScoreTables()
+
+	iter := store.NewIterator([]byte(ScoreBucket))
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()[len(ScoreBucket):]
+		if len(key) == 0 || len(iter.Value()) != 8 {
+			return nil, fmt.Errorf("malformed score entry %q", iter.Key())
+		}
+		table, ok := t[key[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown score kind %q", key[0])
+		}
+		table[string(key[1:])] = int(binary.BigEndian.Uint64(iter.Value()))
+	}
+
+	return t, iter.Error()
+}
+
+// Score keys are namespaced by what a block is credited to, so that the team
+// "carol" and blocks listing just the member carol are counted apart.
+const (
+	scoreTeamPrefix    = "team:"
+	scoreMembersPrefix = "members:"
+	scoreRawPrefix     = "raw:"
+)
+
+// scoreLabel is a score key without its namespace.
+func scoreLabel(key string) string {
+	for _, prefix := range []string{scoreTeamPrefix, scoreMembersPrefix, scoreRawPrefix} {
+		if strings.HasPrefix(key, prefix) {
+			return key[len(prefix):]
+		}
+	}
+	return key
+}
+
+// teamNames looks up the team registered with a canonical member list.
+type teamNames func(members string) (string, error)
+
+// scoreName is the score key a block is credited to: the registered team
+// that signed it or whose members it lists, or else its canonical member
+// list.  Blocks that predate payload validation, like the genesis block, are
+// credited to their raw contents.
+func scoreName(names teamNames, h *coin.Header, b string) string {
+	team, err := canonicalTeam(h, coin.Block(b))
+	if err != nil {
+		return scoreRawPrefix + b
+	}
+	if h.Version == 2 {
+		return scoreTeamPrefix + team
+	}
+	if name, err := names(team); err == nil {
+		return scoreTeamPrefix + name
+	}
+	return scoreMembersPrefix + team
+}
+
+func (bc *blockchain) scoreName(h *coin.Header, b string) string {
+	return scoreName(bc.teamByMembers, h, b)
+}
+
+// legacyScoreName is scoreName before schema version 5.
+func legacyScoreName(h *coin.Header, b string) string {
+	if h.Version == 2 {
+		if p, err := coin.Block(b).Payload(); err == nil {
+			return p.Team
+		}
+	}
+	return b
+}
+
+// computeScores recomputes the score tables from every stored header,
+// crediting blocks to their raw contents.
+func computeScores(store ChainStore) (scoreTables, error) {
+	return recountScores(store, func(h *coin.Header, b string) string { return b })
+}
+
+// recountScores recomputes the score tables from every stored header,
+// crediting blocks to name.
+func recountScores(store ChainStore, name func(h *coin.Header, b string) string) (scoreTables, error) {
+	t := newScoreTables()
+
+	iter := store.NewIterator([]byte(HeaderBucket))
+	defer iter.Release()
+	for iter.Next() {
+		var pheader processedHeader
+		if err := pheader.UnmarshalBinary(iter.Value()); err != nil {
+			return nil, err
+		}
+
+		// Load block data and convert to string
+		b, err := store.Get(bucket(BlockBucket, pheader.Header.Sum()))
+		if err != nil {
+			continue
+		}
+		teamname := name(&pheader.Header, string(b))
+
+		t[scoreTotal][teamname]++
+		if pheader.IsMainChain {
+			t[scoreMain][teamname]++
+		}
+		if pheader.EverMainChain {
+			t[scoreEver][teamname]++
+		}
+	}
+
+	return t, iter.Error()
+}
+
+// VerifyScores recomputes the score tables of the LevelDB database at path
+// from scratch, reports every counter that drifted to w, and rewrites the
+// persisted tables if fix is set.  It returns the number of drifted counters.
+func VerifyScores(path string, fix bool, w io.Writer) (int, error) {
+	store, err := OpenLevelDBStore(path)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	if err := checkSchema(store); err != nil {
+		return 0, err
+	}
+
+	return verifyScores(store, fix, w)
+}
+
+func verifyScores(store ChainStore, fix bool, w io.Writer) (int, error) {
+	stored, err := readScores(store)
+	if err != nil {
+		return 0, err
+	}
+	computed, err := recountScores(store, func(h *coin.Header, b string) string {
+		return scoreName(storeTeamNames(store), h, b)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	drift := 0
+	batch := store.NewBatch()
+	for _, kind := range scoreKinds {
+		teams := make(map[string]struct{})
+		for team := range stored[kind] {
+			teams[team] = struct{}{}
+		}
+		for team := range computed[kind] {
+			teams[team] = struct{}{}
+		}
+
+		sorted := make([]string, 0, len(teams))
+		for team := range teams {
+			sorted = append(sorted, team)
+		}
+		sort.Strings(sorted)
+
+		for _, team := range sorted {
+			have, want := stored[kind][team], computed[kind][team]
+			if have == want {
+				continue
+			}
+			drift++
+			fmt.Fprintf(w, "%c %q: stored %d, computed %d\n", kind, team, have, want)
+			putScore(batch, kind, team, want)
+		}
+	}
+
+	if fix && drift > 0 {
+		return drift, store.Write(batch)
+	}
+	return drift, nil
+}
+
+func upScoreTables(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	t, err := computeScores(store)
+	if err != nil {
+		return err
+	}
+	for kind, table := range t {
+		for team, n := range table {
+			putScore(batch, kind, team, n)
+		}
+	}
+
+	return nil
+}
+
+func downScoreTables(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	iter := store.NewIterator([]byte(ScoreBucket))
+	defer iter.Release()
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+
+	return iter.Error()
+}
+
+// rewriteScoreTables replaces the persisted score tables with a recount
+// crediting blocks to name.
+func rewriteScoreTables(store ChainStore, batch StoreBatch, name func(h *coin.Header, b string) string) error {
+	if err := downScoreTables(store, nil, batch); err != nil {
+		return err
+	}
+
+	t, err := recountScores(store, name)
+	if err != nil {
+		return err
+	}
+	for kind, table := range t {
+		for team, n := range table {
+			putScore(batch, kind, team, n)
+		}
+	}
+
+	return nil
+}
+
+// upCanonicalScores indexes the registered teams by member list, and rekeys
+// the score tables by scoreName.
+func upCanonicalScores(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	byMembers := make(map[string]string)
+	iter := store.NewIterator([]byte(TeamBucket))
+	defer iter.Release()
+	for iter.Next() {
+		t := new(Team)
+		if err := json.Unmarshal(iter.Value(), t); err != nil {
+			return err
+		}
+		members := strings.Join(t.Members, coin.EntrySeparator)
+		if _, ok := byMembers[members]; ok {
+			log.Printf("[Migrate] team %s has the same members as team %s\n", t.Name, byMembers[members])
+			continue
+		}
+		byMembers[members] = t.Name
+		batch.Put([]byte(MembersBucket+members), []byte(t.Name))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	names := func(members string) (string, error) {
+		if name, ok := byMembers[members]; ok {
+			return name, nil
+		}
+		return "", ErrNotFound
+	}
+	return rewriteScoreTables(store, batch, func(h *coin.Header, b string) string {
+		return scoreName(names, h, b)
+	})
+}
+
+func downCanonicalScores(store ChainStore, params *ChainParams, batch StoreBatch) error {
+	iter := store.NewIterator([]byte(MembersBucket))
+	defer iter.Release()
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return rewriteScoreTables(store, batch, legacyScoreName)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"../coin"
+)
+
+func sameScores(have, want map[string]int) bool {
+	if len(have) != len(want) {
+		return false
+	}
+	for team, n := range want {
+		if have[team] != n {
+			return false
+		}
+	}
+	return true
+}
+
+func checkScores(t *testing.T, bc *blockchain, want map[string]int) {
+	t.Helper()
+	if !sameScores(bc.scores, want) {
+		t.Errorf("scores %v, want %v", bc.scores, want)
+	}
+	if drift, err := verifyScores(bc.store, false, ioutil.Discard); err != nil || drift != 0 {
+		t.Errorf("verify-scores found %d drifted counters, %v", drift, err)
+	}
+}
+
+func TestScoresByRegisteredTeam(t *testing.T) {
+	c := newTestChain(t)
+	genesisContents, err := c.bc.getBlock(c.genesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisName := scoreRawPrefix + genesisContents
+
+	// Mined before the team registered
+	id, ts := c.extend(c.genesis(), testGenesisTime, 1, time.Second, "bob, Alice")
+	checkScores(t, c.bc, map[string]int{genesisName: 1, "members:alice,bob": 1})
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, team := range []*Team{
+		{Name: "team1", Members: []string{"Alice", "bob"}},
+		{Name: "team2", Members: []string{"carol"}, PublicKey: public},
+	} {
+		if _, err := c.bc.registerTeam(team); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.bc.registerTeam(&Team{Name: "team3", Members: []string{"bob", "alice"}}); err != ErrTeamMembers {
+		t.Errorf("registering the same members twice: got %v, want %v", err, ErrTeamMembers)
+	}
+	checkScores(t, c.bc, map[string]int{genesisName: 1, "team:team1": 1})
+
+	id, ts = c.extend(id, ts, 1, time.Second, "alice,BOB")
+
+	h := coin.Header{ParentID: id, Difficulty: c.bc.currDifficulty,
+		Timestamp: ts.Add(time.Second).UnixNano(), Version: 2}
+	b, err := coin.NewSignedBlock(&h, "team2", []string{"carol"}, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.MineBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	c.clock.Set(ts.Add(time.Second))
+	if err := c.bc.AddBlock(h, b); err != nil {
+		t.Fatal(err)
+	}
+	checkScores(t, c.bc, map[string]int{genesisName: 1, "team:team1": 2, "team:team2": 1})
+
+	// Schema 4 credited blocks to their raw contents, or signing team
+	if err := migrate(c.bc.store, c.bc.params, 4); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := readScores(c.bc.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{genesisContents: 1, "bob, Alice": 1, "alice,BOB": 1, "team2": 1}
+	if !sameScores(legacy[scoreTotal], want) {
+		t.Errorf("schema 4 scores %v, want %v", legacy[scoreTotal], want)
+	}
+
+	if err := migrate(c.bc.store, c.bc.params, SchemaVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.bc.loadScores(); err != nil {
+		t.Fatal(err)
+	}
+	checkScores(t, c.bc, map[string]int{genesisName: 1, "team:team1": 2, "team:team2": 1})
+	if name, err := c.bc.teamByMembers("alice,bob"); err != nil || name != "team1" {
+		t.Errorf("member index after migrating: %q, %v", name, err)
+	}
+}
+
+func TestScoreNamespaces(t *testing.T) {
+	c := newTestChain(t)
+	genesisContents, err := c.bc.getBlock(c.genesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The team carol, and blocks listing the unregistered member carol
+	if _, err := c.bc.registerTeam(&Team{Name: "carol", Members: []string{"dave"}}); err != nil {
+		t.Fatal(err)
+	}
+	id, ts := c.extend(c.genesis(), testGenesisTime, 2, time.Second, "carol")
+	c.extend(id, ts, 1, time.Second, "dave")
+	checkScores(t, c.bc, map[string]int{scoreRawPrefix + genesisContents: 1,
+		"members:carol": 2, "team:carol": 1})
+
+	if label := scoreLabel("members:carol"); label != "carol" {
+		t.Errorf("scoreLabel = %q, want carol", label)
+	}
+}
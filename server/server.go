@@ -4,63 +4,147 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"../coin"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type (
 	exploreBlock struct {
-		ID              coin.Hash   `json:"id"`
-		Header          coin.Header `json:"header"`
-		Block           coin.Block  `json:"block"`
-		BlockHeight     uint64      `json:"blockheight"`
-		IsMainChain     bool        `json:"ismainchain"`
-		EverMainChain   bool        `json:"evermainchain"`
-		TotalDifficulty uint64      `json:"totaldiff"`
-		Timestamp       time.Time   `json:"timestamp"`
+		ID               coin.Hash   `json:"id"`
+		Header           coin.Header `json:"header"`
+		Block            coin.Block  `json:"block"`
+		BlockHeight      uint64      `json:"blockheight"`
+		IsMainChain      bool        `json:"ismainchain"`
+		EverMainChain    bool        `json:"evermainchain"`
+		TotalDifficulty  uint64      `json:"totaldiff"`
+		TargetDifficulty uint64      `json:"targetdiff"`
+		Timestamp        time.Time   `json:"timestamp"`
 	}
 
 	compositeBlock struct {
 		Header coin.Header `json:"header"`
 		Block  coin.Block  `json:"block"`
 	}
+
+	merkleProofReport struct {
+		ID       coin.Hash            `json:"id"`
+		Header   coin.Header          `json:"header"`
+		Index    int                  `json:"index"`
+		Entry    string               `json:"entry"`
+		Siblings []coin.MerkleSibling `json:"siblings"`
+	}
 )
 
 func newExploreBlock(pheader *processedHeader, b coin.Block) *exploreBlock {
 	return &exploreBlock{
-		ID:              pheader.Header.Sum(),
-		Header:          pheader.Header,
-		Block:           b,
-		BlockHeight:     pheader.BlockHeight,
-		IsMainChain:     pheader.IsMainChain,
-		EverMainChain:   pheader.EverMainChain,
-		TotalDifficulty: pheader.TotalDifficulty,
-		Timestamp:       time.Unix(0, pheader.Header.Timestamp),
+		ID:               pheader.Header.Sum(),
+		Header:           pheader.Header,
+		Block:            b,
+		BlockHeight:      pheader.BlockHeight,
+		IsMainChain:      pheader.IsMainChain,
+		EverMainChain:    pheader.EverMainChain,
+		TotalDifficulty:  pheader.TotalDifficulty,
+		TargetDifficulty: pheader.TargetDifficulty,
+		Timestamp:        time.Unix(0, pheader.Header.Timestamp),
+	}
+}
+
+// Requests and responses use the binary wire format from package coin
+// instead of JSON when they carry this content type.
+const binaryContentType = "application/octet-stream"
+
+// UnmarshalBinary decodes a binary header immediately followed by a binary
+// block.
+func (cb *compositeBlock) UnmarshalBinary(b []byte) error {
+	if len(b) < coin.HeaderSize {
+		return coin.ErrHeaderEncoding
+	}
+	if err := cb.Header.UnmarshalBinary(b[:coin.HeaderSize]); err != nil {
+		return err
 	}
+	return cb.Block.UnmarshalBinary(b[coin.HeaderSize:])
 }
 
 func addHandler(w http.ResponseWriter, r *http.Request) {
 	req := new(compositeBlock)
-	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		httpError(w, http.StatusBadRequest, "error parsing block json: %s", err)
+	if r.Header.Get("Content-Type") == binaryContentType {
+		// Header, block length and the largest block we accept
+		maxSize := int64(coin.HeaderSize + 4 + bchain.params.MaxBlockSize)
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+		if err == nil {
+			err = req.UnmarshalBinary(body)
+		}
+		if err != nil {
+			writeRejection(w, http.StatusBadRequest, rejection{RejectMalformed,
+				"error parsing binary block: " + err.Error()}, err)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeRejection(w, http.StatusBadRequest, rejection{RejectMalformed,
+			"error parsing block json: " + err.Error()}, err)
+		return
+	}
+
+	// Only credit blocks to the team submitting them
+	team, err := bchain.teamByAPIKey(r.Header.Get("X-API-Key"))
+	if err == nil {
+		var owned bool
+		if owned, err = team.owns(&req.Header, req.Block); err == nil && !owned {
+			err = ErrTeamMismatch
+		}
+	}
+	if err != nil {
+		rejectBlock(w, err)
 		return
 	}
 
 	if err := bchain.AddBlock(req.Header, req.Block); err != nil {
-		httpError(w, http.StatusBadRequest, "failed to add block: %s", err)
+		rejectBlock(w, err)
 		return
 	}
 	w.Write([]byte("success"))
 }
 
+// LongPollTimeout is how long /next?since=<hash> waits for a new head before
+// answering with the current one.
+var LongPollTimeout = 30 * time.Second
+
 func nextHandler(w http.ResponseWriter, r *http.Request) {
+	var since coin.Hash
+	longPoll := r.URL.Query().Get("since") != ""
+	if longPoll {
+		var err error
+		if since, err = coin.NewHash(r.URL.Query().Get("since")); err != nil {
+			httpError(w, http.StatusBadRequest, "error reading since: %s", err)
+			return
+		}
+	}
+
+	timeout := time.NewTimer(LongPollTimeout)
+	defer timeout.Stop()
+
 	bchain.Lock()
+	for longPoll && bchain.head.Header.Sum() == since {
+		changed := bchain.headChanged
+		bchain.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			longPoll = false
+		case <-r.Context().Done():
+			return
+		}
+
+		bchain.Lock()
+	}
 	head := bchain.head
 	diff := bchain.currDifficulty
 	bchain.Unlock()
@@ -71,13 +155,7 @@ func nextHandler(w http.ResponseWriter, r *http.Request) {
 		Version:    0x00,
 	}
 
-	j, err := json.MarshalIndent(nextHeader, "", "  ")
-	if err != nil {
-		httpError(w, http.StatusInternalServerError, "json encoding error: %s", err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+	writeHeader(w, r, &nextHeader)
 }
 
 func headHandler(w http.ResponseWriter, r *http.Request) {
@@ -85,7 +163,24 @@ func headHandler(w http.ResponseWriter, r *http.Request) {
 	head := bchain.head
 	bchain.Unlock()
 
-	j, err := json.MarshalIndent(head.Header, "", "  ")
+	writeHeader(w, r, &head.Header)
+}
+
+// writeHeader responds with h in the binary wire format if the client accepts
+// it, and as JSON otherwise.
+func writeHeader(w http.ResponseWriter, r *http.Request, h *coin.Header) {
+	if r.Header.Get("Accept") == binaryContentType {
+		b, err := h.MarshalBinary()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "binary encoding error: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", binaryContentType)
+		w.Write(b)
+		return
+	}
+
+	j, err := json.MarshalIndent(h, "", "  ")
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "json encoding error: %s", err)
 		return
@@ -98,14 +193,15 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	bchain.Lock()
 
 	matches := make(map[coin.Hash]coin.Block)
-	iter := bchain.db.NewIterator(util.BytesPrefix([]byte(BlockBucket)), nil)
+	iter := bchain.store.NewIterator([]byte(BlockBucket))
+	defer iter.Release()
 	for iter.Next() {
 		contents := string(iter.Value())
 		if !strings.Contains(contents, r.URL.Path) {
 			continue
 		}
 
-		hex := hex.EncodeToString(iter.Key()[6:])
+		hex := hex.EncodeToString(iter.Key()[len(BlockBucket):])
 		hash, err := coin.NewHash(hex)
 		if err != nil {
 			bchain.Unlock()
@@ -115,6 +211,11 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 		matches[hash] = coin.Block(contents)
 	}
+	if err := iter.Error(); err != nil {
+		bchain.Unlock()
+		httpError(w, http.StatusInternalServerError, "failed to search blocks: %s", err)
+		return
+	}
 
 	blocks := make([]exploreBlock, len(matches))
 	i := 0
@@ -174,6 +275,68 @@ func blockHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+func proofHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 2 {
+		httpError(w, http.StatusBadRequest, "expecting /proof/<hash>/<index>")
+		return
+	}
+	h, err := coin.NewHash(parts[0])
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "error reading hash: %s", err)
+		return
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "error reading index: %s", err)
+		return
+	}
+
+	// Lock and load header, then block
+	bchain.Lock()
+	ph, err := bchain.getHeader(h)
+	if err != nil {
+		bchain.Unlock()
+		httpError(w, http.StatusNotFound, "header not found: %x", h[:])
+		return
+	}
+	blockBytes, err := bchain.getBlock(h)
+	if err != nil {
+		bchain.Unlock()
+		httpError(w, http.StatusNotFound, "block not found: %x", h[:])
+		return
+	}
+	bchain.Unlock()
+
+	entries, err := coin.MerkleEntries(ph.Header.Version, coin.Block(blockBytes))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "version %d blocks have no merkle tree", ph.Header.Version)
+		return
+	}
+
+	proof, err := coin.NewMerkleProof(entries, index)
+	if err != nil {
+		httpError(w, http.StatusNotFound, "%s: %d", err, index)
+		return
+	}
+
+	report := &merkleProofReport{
+		ID:       h,
+		Header:   ph.Header,
+		Index:    index,
+		Entry:    entries[index],
+		Siblings: proof.Siblings,
+	}
+
+	j, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encoding error: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
 type scoreReport struct {
 	Height          uint64         `json:"height"`
 	TotalDifficulty uint64         `json:"totaldifficulty"`
@@ -202,6 +365,19 @@ func scoresHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+func orphansHandler(w http.ResponseWriter, r *http.Request) {
+	bchain.Lock()
+	j, err := json.MarshalIndent(bchain.orphans.list(bchain.clock.Now()), "", "  ")
+	bchain.Unlock()
+
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encoding error: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	data, err := ioutil.ReadFile("templates/index.html")
 	if err != nil {
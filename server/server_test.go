@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"../coin"
+)
+
+// nextHeader requests /next?since=<since>, and delivers the header it
+// answers with once it does.
+func nextHeader(t *testing.T, since coin.Hash) <-chan coin.Header {
+	r := httptest.NewRequest("GET", "/next?since="+since.String(), nil)
+	answered := make(chan coin.Header, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		nextHandler(w, r)
+
+		var h coin.Header
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Errorf("/next answered %d %q: %v", w.Code, w.Body.String(), err)
+		}
+		answered <- h
+	}()
+	return answered
+}
+
+func useChain(t *testing.T) *testChain {
+	c := newTestChain(t)
+	saved := bchain
+	bchain = c.bc
+	t.Cleanup(func() { bchain = saved })
+	return c
+}
+
+func TestNextLongPoll(t *testing.T) {
+	c := useChain(t)
+	head := c.genesis()
+
+	answered := nextHeader(t, head)
+	select {
+	case h := <-answered:
+		t.Fatalf("answered %s before the head changed", h.ParentID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	next, _ := c.extend(head, testGenesisTime, 1, time.Second, "alice")
+	select {
+	case h := <-answered:
+		if h.ParentID != next {
+			t.Errorf("answered parent %s, want the new head %s", h.ParentID, next)
+		}
+		if h.Difficulty != c.bc.currDifficulty {
+			t.Errorf("answered difficulty %d, want %d", h.Difficulty, c.bc.currDifficulty)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer after the head changed")
+	}
+}
+
+func TestNextSinceOldHead(t *testing.T) {
+	c := useChain(t)
+	old := c.genesis()
+	head, _ := c.extend(old, testGenesisTime, 1, time.Second, "alice")
+
+	select {
+	case h := <-nextHeader(t, old):
+		if h.ParentID != head {
+			t.Errorf("answered parent %s, want the head %s", h.ParentID, head)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waited although since is not the head")
+	}
+}
+
+func TestNextTimeout(t *testing.T) {
+	defer func(d time.Duration) { LongPollTimeout = d }(LongPollTimeout)
+	LongPollTimeout = 50 * time.Millisecond
+
+	c := useChain(t)
+	head := c.genesis()
+
+	start := time.Now()
+	select {
+	case h := <-nextHeader(t, head):
+		if h.ParentID != head {
+			t.Errorf("answered parent %s, want the head %s", h.ParentID, head)
+		}
+		if elapsed := time.Since(start); elapsed < LongPollTimeout {
+			t.Errorf("answered after %s, before the timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer after the timeout")
+	}
+}
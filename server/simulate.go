@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"../coin/miner"
+)
+
+// SimOptions describe a simulated hashpower schedule.  Mining a block of
+// difficulty d takes an exponentially distributed time with mean
+// miner.Work(d) / hashpower.
+type SimOptions struct {
+	Blocks int
+	Seed   int64
+
+	// Hashpower starts out at 2^Headroom times what mines blocks of
+	// MinimumDifficulty on target, then drops by a factor of Drop after
+	// Blocks/2 (the deadline).
+	Headroom float64
+	Drop     float64
+}
+
+// SimResult summarizes the block times of a simulated chain.
+type SimResult struct {
+	Algorithm string
+	Mean      time.Duration
+	StdDev    time.Duration
+	Max       time.Duration
+
+	// Time until the block interval recovered after the drop
+	Recovery time.Duration
+}
+
+// Simulate mines a chain with each difficulty algorithm under the same
+// hashpower schedule and writes a comparison of their block times to w.
+func Simulate(params *ChainParams, o SimOptions, w io.Writer) ([]SimResult, error) {
+	// Retargets are only worth logging on the live chain
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	var results []SimResult
+	for _, algorithm := range []string{DifficultyWindow, DifficultyLWMA} {
+		p := *params
+		p.DifficultyAlgorithm = algorithm
+		if algorithm == DifficultyLWMA && p.LWMAWindow == 0 {
+			p.LWMAWindow = 60
+		}
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		results = append(results, simulate(&p, o))
+	}
+
+	fmt.Fprintf(w, "%d blocks, target %s, hashpower drops %gx after block %d\n\n",
+		o.Blocks, time.Duration(params.TargetBlockInterval), o.Drop, o.Blocks/2)
+	fmt.Fprintf(w, "%-10s %12s %12s %12s %12s\n", "algorithm", "mean", "stddev", "max", "recovery")
+	for _, r := range results {
+		fmt.Fprintf(w, "%-10s %12s %12s %12s %12s\n", r.Algorithm,
+			r.Mean.Round(time.Millisecond), r.StdDev.Round(time.Millisecond),
+			r.Max.Round(time.Millisecond), r.Recovery.Round(time.Millisecond))
+	}
+
+	return results, nil
+}
+
+func simulate(params *ChainParams, o SimOptions) SimResult {
+	rng := rand.New(rand.NewSource(o.Seed))
+	T := float64(params.TargetBlockInterval)
+	hashpower := miner.Work(params.MinimumDifficulty) * math.Exp2(o.Headroom) / T
+
+	chain := []*processedHeader{{
+		TargetDifficulty: params.MinimumDifficulty,
+	}}
+	chain[0].Header.Difficulty = params.MinimumDifficulty
+
+	var times []float64
+	var dropTime, recovered float64
+	for i := 1; i <= o.Blocks; i++ {
+		if i == o.Blocks/2+1 {
+			hashpower /= o.Drop
+			dropTime = float64(chain[len(chain)-1].Header.Timestamp)
+		}
+
+		parent := chain[len(chain)-1]
+		target := simTarget(params, chain)
+
+		// Recovered once the expected block time is back within 2x of target
+		expected := miner.Work(target) / hashpower
+		if dropTime != 0 && recovered == 0 && expected < 2*T {
+			recovered = float64(parent.Header.Timestamp) - dropTime
+		}
+
+		solve := rng.ExpFloat64() * expected
+
+		ph := &processedHeader{
+			BlockHeight:      parent.BlockHeight + 1,
+			TotalDifficulty:  parent.TotalDifficulty + target,
+			TargetDifficulty: target,
+		}
+		ph.Header.Difficulty = target
+		ph.Header.Timestamp = parent.Header.Timestamp + int64(solve)
+		chain = append(chain, ph)
+		times = append(times, solve)
+	}
+
+	var sum, max float64
+	for _, t := range times {
+		sum += t
+		max = math.Max(max, t)
+	}
+	mean := sum / float64(len(times))
+	var sq float64
+	for _, t := range times {
+		sq += (t - mean) * (t - mean)
+	}
+
+	return SimResult{
+		Algorithm: params.DifficultyAlgorithm,
+		Mean:      time.Duration(mean),
+		StdDev:    time.Duration(math.Sqrt(sq / float64(len(times)))),
+		Max:       time.Duration(max),
+		Recovery:  time.Duration(recovered),
+	}
+}
+
+// simTarget is computeDifficulty over an in memory chain.
+func simTarget(params *ChainParams, chain []*processedHeader) uint64 {
+	header := chain[len(chain)-1]
+	if params.DifficultyAlgorithm == DifficultyLWMA {
+		start := len(chain) - 1 - params.LWMAWindow
+		if start < 0 {
+			start = 0
+		}
+		return lwmaTargetDifficulty(params, chain[start:])
+	}
+
+	h := header.BlockHeight
+	pastHeader := chain[h-h%params.RetargetWindow()]
+	return nextTargetDifficulty(params, header, pastHeader)
+}
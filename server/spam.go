@@ -0,0 +1,154 @@
+package server
+
+import (
+	"container/list"
+	"encoding/binary"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"../coin"
+)
+
+const (
+	// SpamBucket remembers rejected headers across restarts: the value is
+	// the 8-byte big-endian time the header was rejected, then the reason.
+	SpamBucket = "SPAM-"
+
+	// Most headers remembered at once; the least recently seen go first
+	MaxSpamEntries = 100000
+
+	// Headers are forgotten after this long
+	SpamExpiry = 24 * time.Hour
+)
+
+// Reasons a header is in the spam filter
+const (
+	spamDuplicate byte = iota
+	spamInvalidPoW
+)
+
+type (
+	// spamFilter is a size and age bounded LRU of rejected header ids,
+	// mirrored to the store.  It has its own lock so headers can be checked
+	// before validation, without holding the blockchain lock.
+	spamFilter struct {
+		sync.Mutex
+		store   ChainStore
+		entries map[coin.Hash]*list.Element
+		lru     *list.List // of *spamEntry, most recently seen first
+	}
+
+	spamEntry struct {
+		id     coin.Hash
+		seen   time.Time
+		reason byte
+	}
+)
+
+// loadSpamFilter reads the persisted filter, dropping expired entries.
+func loadSpamFilter(store ChainStore, now time.Time) (*spamFilter, error) {
+	sf := &spamFilter{
+		store:   store,
+		entries: make(map[coin.Hash]*list.Element),
+		lru:     list.New(),
+	}
+
+	var loaded []*spamEntry
+	iter := store.NewIterator([]byte(SpamBucket))
+	defer iter.Release()
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if len(key) != len(SpamBucket)+len(coin.Hash{}) || len(value) != 9 {
+			continue
+		}
+		e := &spamEntry{
+			seen:   time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+			reason: value[8],
+		}
+		copy(e.id[:], key[len(SpamBucket):])
+		loaded = append(loaded, e)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].seen.After(loaded[j].seen)
+	})
+	for _, e := range loaded {
+		sf.entries[e.id] = sf.lru.PushBack(e)
+	}
+	sf.trim(now)
+
+	return sf, nil
+}
+
+// check returns the error a header was rejected with, or nil if it is not in
+// the filter.
+func (sf *spamFilter) check(id coin.Hash, now time.Time) error {
+	sf.Lock()
+	defer sf.Unlock()
+
+	el, ok := sf.entries[id]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*spamEntry)
+	if now.Sub(e.seen) > SpamExpiry {
+		sf.remove(el)
+		return nil
+	}
+
+	sf.lru.MoveToFront(el)
+	if e.reason == spamInvalidPoW {
+		return coin.ErrInvalidPoW
+	}
+	return ErrSpamHeader
+}
+
+func (sf *spamFilter) add(id coin.Hash, reason byte, now time.Time) {
+	sf.Lock()
+	defer sf.Unlock()
+
+	if el, ok := sf.entries[id]; ok {
+		sf.remove(el)
+	}
+
+	e := &spamEntry{id: id, seen: now, reason: reason}
+	sf.entries[id] = sf.lru.PushFront(e)
+	sf.persist(e)
+	sf.trim(now)
+}
+
+// trim drops expired entries and the least recently seen beyond the limit.
+func (sf *spamFilter) trim(now time.Time) {
+	for el := sf.lru.Back(); el != nil; el = sf.lru.Back() {
+		e := el.Value.(*spamEntry)
+		if sf.lru.Len() <= MaxSpamEntries && now.Sub(e.seen) <= SpamExpiry {
+			break
+		}
+		sf.remove(el)
+	}
+}
+
+func (sf *spamFilter) remove(el *list.Element) {
+	e := sf.lru.Remove(el).(*spamEntry)
+	delete(sf.entries, e.id)
+	if err := sf.store.Delete(bucket(SpamBucket, e.id)); err != nil {
+		log.Printf("[Spam] unable to delete %s: %s\n", e.id, err)
+	}
+}
+
+// persist records e in the store.  The filter only saves work, so failures
+// are logged rather than returned.
+func (sf *spamFilter) persist(e *spamEntry) {
+	value := make([]byte, 9)
+	binary.BigEndian.PutUint64(value, uint64(e.seen.UnixNano()))
+	value[8] = e.reason
+	if err := sf.store.Put(bucket(SpamBucket, e.id), value); err != nil {
+		log.Printf("[Spam] unable to save %s: %s\n", e.id, err)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"../coin"
+)
+
+func spamID(i int) coin.Hash {
+	var id coin.Hash
+	binary.BigEndian.PutUint64(id[:], uint64(i))
+	return id
+}
+
+func TestSpamFilterCheck(t *testing.T) {
+	sf, err := loadSpamFilter(NewMemoryStore(), testGenesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.add(spamID(1), spamDuplicate, testGenesisTime)
+	sf.add(spamID(2), spamInvalidPoW, testGenesisTime)
+
+	tests := []struct {
+		id   coin.Hash
+		want error
+	}{
+		{spamID(0), nil},
+		{spamID(1), ErrSpamHeader},
+		{spamID(2), coin.ErrInvalidPoW},
+	}
+	for _, test := range tests {
+		if err := sf.check(test.id, testGenesisTime); err != test.want {
+			t.Errorf("check(%x) = %v, want %v", test.id[:8], err, test.want)
+		}
+	}
+}
+
+func TestSpamFilterExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	sf, err := loadSpamFilter(store, testGenesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.add(spamID(1), spamDuplicate, testGenesisTime)
+	sf.add(spamID(2), spamDuplicate, testGenesisTime.Add(time.Hour))
+
+	// Checking a header does not extend its expiry
+	now := testGenesisTime.Add(SpamExpiry)
+	if err := sf.check(spamID(1), now); err != ErrSpamHeader {
+		t.Fatalf("check at expiry: got %v, want %v", err, ErrSpamHeader)
+	}
+	now = now.Add(time.Nanosecond)
+	if err := sf.check(spamID(1), now); err != nil {
+		t.Errorf("check after expiry: got %v, want nil", err)
+	}
+	if _, err := store.Get(bucket(SpamBucket, spamID(1))); err != ErrNotFound {
+		t.Errorf("expired header is still stored: %v", err)
+	}
+
+	// Adding a header trims the others that have expired
+	now = testGenesisTime.Add(SpamExpiry + time.Hour + time.Nanosecond)
+	sf.add(spamID(3), spamDuplicate, now)
+	if _, ok := sf.entries[spamID(2)]; ok {
+		t.Error("expired header was not trimmed")
+	}
+	if err := sf.check(spamID(3), now); err != ErrSpamHeader {
+		t.Errorf("check(3) = %v, want %v", err, ErrSpamHeader)
+	}
+}
+
+func TestSpamFilterSize(t *testing.T) {
+	store := NewMemoryStore()
+	sf, err := loadSpamFilter(store, testGenesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < MaxSpamEntries; i++ {
+		sf.add(spamID(i), spamDuplicate, testGenesisTime)
+	}
+
+	// Header 0 is seen again, so header 1 is the least recently seen
+	if err := sf.check(spamID(0), testGenesisTime); err != ErrSpamHeader {
+		t.Fatalf("check(0) = %v, want %v", err, ErrSpamHeader)
+	}
+	sf.add(spamID(MaxSpamEntries), spamDuplicate, testGenesisTime)
+
+	if n := len(sf.entries); n != MaxSpamEntries {
+		t.Errorf("%d entries, want %d", n, MaxSpamEntries)
+	}
+	if err := sf.check(spamID(1), testGenesisTime); err != nil {
+		t.Errorf("least recently seen header was kept: %v", err)
+	}
+	if _, err := store.Get(bucket(SpamBucket, spamID(1))); err != ErrNotFound {
+		t.Errorf("trimmed header is still stored: %v", err)
+	}
+	for _, i := range []int{0, 2, MaxSpamEntries} {
+		if err := sf.check(spamID(i), testGenesisTime); err != ErrSpamHeader {
+			t.Errorf("check(%d) = %v, want %v", i, err, ErrSpamHeader)
+		}
+	}
+}
+
+func TestSpamFilterReload(t *testing.T) {
+	store := NewMemoryStore()
+	sf, err := loadSpamFilter(store, testGenesisTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf.add(spamID(1), spamDuplicate, testGenesisTime)
+	sf.add(spamID(2), spamInvalidPoW, testGenesisTime.Add(time.Hour))
+	sf.add(spamID(3), spamDuplicate, testGenesisTime.Add(2*time.Hour))
+
+	// Header 1 expires while the server is down
+	now := testGenesisTime.Add(SpamExpiry + time.Minute)
+	sf, err = loadSpamFilter(store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(sf.entries); n != 2 {
+		t.Errorf("reloaded %d entries, want 2", n)
+	}
+	if _, err := store.Get(bucket(SpamBucket, spamID(1))); err != ErrNotFound {
+		t.Errorf("expired header is still stored: %v", err)
+	}
+
+	// Most recently seen first, as before the restart
+	if e := sf.lru.Back().Value.(*spamEntry); e.id != spamID(2) || e.reason != spamInvalidPoW ||
+		!e.seen.Equal(testGenesisTime.Add(time.Hour)) {
+		t.Errorf("least recently seen entry %x %d %s", e.id[:8], e.reason, e.seen)
+	}
+	if err := sf.check(spamID(2), now); err != coin.ErrInvalidPoW {
+		t.Errorf("check(2) = %v, want %v", err, coin.ErrInvalidPoW)
+	}
+	if err := sf.check(spamID(3), now); err != ErrSpamHeader {
+		t.Errorf("check(3) = %v, want %v", err, ErrSpamHeader)
+	}
+}
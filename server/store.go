@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// ChainStore is the ordered key/value store the blockchain is kept in.  Keys
+// are bucketed by prefix (see bucket), so the store only has to support
+// point lookups, atomic batches and prefix scans.  It must be safe for
+// concurrent use: handlers read it without holding the blockchain lock.
+type ChainStore interface {
+	// Get returns ErrNotFound if key is not present.
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	// NewBatch returns an empty batch for Write.  Batches are only valid for
+	// the store that created them.
+	NewBatch() StoreBatch
+	Write(batch StoreBatch) error
+
+	// NewIterator iterates over all keys beginning with prefix, in order.
+	NewIterator(prefix []byte) StoreIterator
+
+	Close() error
+}
+
+// StoreBatch collects writes that are applied atomically by
+// ChainStore.Write.
+type StoreBatch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+}
+
+// StoreIterator follows the leveldb iterator protocol: call Next before the
+// first Key/Value, and Release when done.
+type StoreIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
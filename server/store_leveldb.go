@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+
+	db "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var errForeignBatch = errors.New("batch was not created by this store")
+
+type levelDBStore struct {
+	db *db.DB
+}
+
+// OpenLevelDBStore opens, creating if necessary, the LevelDB database at
+// path.
+func OpenLevelDBStore(path string) (ChainStore, error) {
+	ldb, err := db.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBStore{db: ldb}, nil
+}
+
+func (s *levelDBStore) Get(key []byte) ([]byte, error) {
+	value, err := s.db.Get(key, nil)
+	if err == db.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *levelDBStore) Put(key, value []byte) error {
+	return s.db.Put(key, value, nil)
+}
+
+func (s *levelDBStore) Delete(key []byte) error {
+	return s.db.Delete(key, nil)
+}
+
+func (s *levelDBStore) NewBatch() StoreBatch {
+	return &db.Batch{}
+}
+
+func (s *levelDBStore) Write(batch StoreBatch) error {
+	b, ok := batch.(*db.Batch)
+	if !ok {
+		return errForeignBatch
+	}
+	return s.db.Write(b, nil)
+}
+
+func (s *levelDBStore) NewIterator(prefix []byte) StoreIterator {
+	return s.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (s *levelDBStore) Close() error {
+	return s.db.Close()
+}
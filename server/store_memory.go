@@ -0,0 +1,144 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore is a ChainStore kept entirely in memory, for tests and
+// simulations.
+type memoryStore struct {
+	mu sync.RWMutex
+	m  map[string][]byte
+}
+
+func NewMemoryStore() ChainStore {
+	return &memoryStore{m: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.m[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *memoryStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.m[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *memoryStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.m, string(key))
+	return nil
+}
+
+type memoryOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+type memoryBatch struct {
+	ops []memoryOp
+}
+
+func (b *memoryBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, memoryOp{key: string(key), value: append([]byte(nil), value...)})
+}
+
+func (b *memoryBatch) Delete(key []byte) {
+	b.ops = append(b.ops, memoryOp{key: string(key), delete: true})
+}
+
+func (s *memoryStore) NewBatch() StoreBatch {
+	return &memoryBatch{}
+}
+
+func (s *memoryStore) Write(batch StoreBatch) error {
+	b, ok := batch.(*memoryBatch)
+	if !ok {
+		return errForeignBatch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, op := range b.ops {
+		if op.delete {
+			delete(s.m, op.key)
+		} else {
+			s.m[op.key] = op.value
+		}
+	}
+	return nil
+}
+
+// memoryIterator walks a snapshot of the matching keys taken when it was
+// created.
+type memoryIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+}
+
+func (s *memoryStore) NewIterator(prefix []byte) StoreIterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	it := &memoryIterator{pos: -1}
+	for k := range s.m {
+		if strings.HasPrefix(k, string(prefix)) {
+			it.keys = append(it.keys, k)
+		}
+	}
+	sort.Strings(it.keys)
+	for _, k := range it.keys {
+		it.values = append(it.values, s.m[k])
+	}
+	return it
+}
+
+func (it *memoryIterator) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	return it.pos < len(it.keys)
+}
+
+func (it *memoryIterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memoryIterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.pos]
+}
+
+func (it *memoryIterator) Release() {
+	it.keys, it.values = nil, nil
+}
+
+func (it *memoryIterator) Error() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
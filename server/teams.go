@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"../coin"
+)
+
+const (
+	// TeamBucket maps a team name to its JSON record
+	TeamBucket = "TEAM-"
+
+	// APIKeyBucket maps the SHA256 of an API key to its team name, so the
+	// keys themselves are never stored
+	APIKeyBucket = "APIKEY-"
+
+	// MembersBucket maps a team's canonical member list to its name
+	MembersBucket = "MEMBERS-"
+
+	maxTeamName = 64
+)
+
+var (
+	ErrTeamExists   = errors.New("team already exists")
+	ErrTeamMembers  = errors.New("another team already has these members")
+	ErrTeamInvalid  = errors.New("team needs a name and members without commas, and a valid public key if any")
+	ErrAPIKey       = errors.New("missing or unknown API key")
+	ErrTeamMismatch = errors.New("block contents do not match the API key's team")
+)
+
+// Team is a registered team.  Its blocks must list exactly its Members, kept
+// in canonical form, or for version 2 blocks, be signed with its PublicKey.
+type Team struct {
+	Name      string            `json:"name"`
+	Members   []string          `json:"members"`
+	PublicKey ed25519.PublicKey `json:"publickey,omitempty"`
+	Created   time.Time         `json:"created"`
+}
+
+// owns reports whether the block h, b belongs to t, or why its contents
+// cannot be credited to any team.
+func (t *Team) owns(h *coin.Header, b coin.Block) (bool, error) {
+	members, err := blockMembers(h, b)
+	if err != nil {
+		return false, err
+	}
+
+	if h.Version == 2 {
+		p, _ := b.Payload()
+		return p.Team == t.Name, nil
+	}
+
+	if len(members) != len(t.Members) {
+		return false, nil
+	}
+	for i, m := range members {
+		if m != t.Members[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *Team) valid() bool {
+	if t.Name == "" || len(t.Name) > maxTeamName || strings.Contains(t.Name, coin.EntrySeparator) {
+		return false
+	}
+	if len(t.PublicKey) != 0 && len(t.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	for _, m := range t.Members {
+		if strings.Contains(m, coin.EntrySeparator) {
+			return false
+		}
+	}
+	return true
+}
+
+func apiKeyHash(key string) coin.Hash {
+	return sha256.Sum256([]byte(key))
+}
+
+// registerTeam stores t with a new API key, which it returns.
+func (bc *blockchain) registerTeam(t *Team) (string, error) {
+	if !t.valid() {
+		return "", ErrTeamInvalid
+	}
+	members, err := canonicalMembers(t.Members)
+	if err != nil {
+		return "", err
+	}
+	t.Members = members
+
+	if _, err := bc.getTeam(t.Name); err == nil {
+		return "", ErrTeamExists
+	} else if err != ErrNotFound {
+		return "", err
+	}
+	joined := strings.Join(members, coin.EntrySeparator)
+	if _, err := bc.teamByMembers(joined); err == nil {
+		return "", ErrTeamMembers
+	} else if err != ErrNotFound {
+		return "", err
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	apiKey := hex.EncodeToString(key[:])
+
+	t.Created = bc.clock.Now()
+	teamBytes, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	// Blocks the members mined before registering move to the team
+	changes := make(scoreChanges)
+	for _, kind := range scoreKinds {
+		if n := bc.scoreTable(kind)[scoreMembersPrefix+joined]; n != 0 {
+			changes.add(kind, scoreMembersPrefix+joined, -n)
+			changes.add(kind, scoreTeamPrefix+t.Name, n)
+		}
+	}
+
+	batch := bc.store.NewBatch()
+	batch.Put([]byte(TeamBucket+t.Name), teamBytes)
+	batch.Put(bucket(APIKeyBucket, apiKeyHash(apiKey)), []byte(t.Name))
+	batch.Put([]byte(MembersBucket+joined), []byte(t.Name))
+	bc.stageScores(changes, batch)
+	if err := bc.store.Write(batch); err != nil {
+		return "", err
+	}
+	bc.applyScores(changes)
+
+	return apiKey, nil
+}
+
+func (bc *blockchain) getTeam(name string) (*Team, error) {
+	teamBytes, err := bc.store.Get([]byte(TeamBucket + name))
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(Team)
+	if err := json.Unmarshal(teamBytes, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// teamByMembers returns the name of the team registered with the canonical
+// member list members.
+func (bc *blockchain) teamByMembers(members string) (string, error) {
+	return storeTeamNames(bc.store)(members)
+}
+
+func storeTeamNames(store ChainStore) teamNames {
+	return func(members string) (string, error) {
+		name, err := store.Get([]byte(MembersBucket + members))
+		if err != nil {
+			return "", err
+		}
+		return string(name), nil
+	}
+}
+
+// teamByAPIKey returns the team key was issued to.
+func (bc *blockchain) teamByAPIKey(key string) (*Team, error) {
+	if key == "" {
+		return nil, ErrAPIKey
+	}
+
+	name, err := bc.store.Get(bucket(APIKeyBucket, apiKeyHash(key)))
+	if err == ErrNotFound {
+		return nil, ErrAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	return bc.getTeam(string(name))
+}
+
+// TeamKey makes the registry a coin.TeamKeys, to verify version 2 blocks.
+func (bc *blockchain) TeamKey(team string) (ed25519.PublicKey, error) {
+	t, err := bc.getTeam(team)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.PublicKey) == 0 {
+		return nil, coin.ErrUnknownTeam
+	}
+	return t.PublicKey, nil
+}
+
+func (bc *blockchain) listTeams() ([]*Team, error) {
+	teams := []*Team{}
+	iter := bc.store.NewIterator([]byte(TeamBucket))
+	defer iter.Release()
+	for iter.Next() {
+		t := new(Team)
+		if err := json.Unmarshal(iter.Value(), t); err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams, nil
+}
+
+/*
+ * Admin API
+ */
+
+// adminHandler only lets through requests bearing token.  Without a token,
+// the admin API does not exist.
+func adminHandler(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			httpError(w, http.StatusUnauthorized, "bad admin token")
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+type registration struct {
+	Team   *Team  `json:"team"`
+	APIKey string `json:"apikey"`
+}
+
+// teamsHandler lists teams on GET and registers one on POST, responding with
+// its API key.  The key cannot be recovered later.
+func teamsHandler(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	status := http.StatusOK
+
+	switch r.Method {
+	case http.MethodGet:
+		bchain.Lock()
+		teams, err := bchain.listTeams()
+		bchain.Unlock()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "error listing teams: %s", err)
+			return
+		}
+		v = teams
+
+	case http.MethodPost:
+		t := new(Team)
+		if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+			httpError(w, http.StatusBadRequest, "error parsing team json: %s", err)
+			return
+		}
+
+		bchain.Lock()
+		key, err := bchain.registerTeam(t)
+		bchain.Unlock()
+		switch err {
+		case nil:
+		case ErrTeamInvalid, ErrTeamExists, ErrTeamMembers, ErrPayloadChars, ErrPayloadMembers:
+			httpError(w, http.StatusBadRequest, "failed to register team: %s", err)
+			return
+		default:
+			httpError(w, http.StatusInternalServerError, "failed to register team: %s", err)
+			return
+		}
+		v = registration{t, key}
+		status = http.StatusCreated
+
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "%s", r.Method)
+		return
+	}
+
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encoding error: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
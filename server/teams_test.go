@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+
+	"../coin"
+)
+
+func TestTeamOwns(t *testing.T) {
+	team := &Team{Name: "team1", Members: []string{"alice", "bob"}}
+
+	tests := []struct {
+		block string
+		owned bool
+		err   error
+	}{
+		{"Bob, alice", true, nil},
+		{"alice", false, nil},
+		{"alice,bob,carol", false, nil},
+		{"alice,ALICE", false, ErrPayloadMembers},
+		{"alice,b!b", false, ErrPayloadChars},
+		{"", false, ErrPayloadMembers},
+	}
+	for _, test := range tests {
+		h := coin.Header{Version: 1}
+		owned, err := team.owns(&h, coin.Block(test.block))
+		if owned != test.owned || err != test.err {
+			t.Errorf("owns(%q) = %t, %v, want %t, %v", test.block, owned, err, test.owned, test.err)
+		}
+	}
+
+	// Malformed lists are answered as such, not as another team's block
+	if _, rej := newRejection(ErrPayloadMembers); rej.Code != RejectBadPayload {
+		t.Errorf("malformed member list answered %s, want %s", rej.Code, RejectBadPayload)
+	}
+}